@@ -0,0 +1,8 @@
+CREATE TABLE session(id text, classifier bytea, ignored bytea, browsed bigint, classified bigint);
+CREATE TABLE story(id bigserial primary key, providerid text, title text, summary text, link text, comments text);
+CREATE TABLE read(sessionid text, storyid bigint);
+CREATE UNIQUE INDEX providx on story(providerid);
+CREATE UNIQUE INDEX sessidx on session(id);
+CREATE UNIQUE INDEX readidx on read(sessionid, storyid);
+CREATE TABLE schemaversion(version integer);
+INSERT INTO schemaversion VALUES (0);
@@ -0,0 +1,96 @@
+/*
+ * Administration requests, served on a separate address that is only
+ * reachable from the local machine by default
+ */
+
+package admin
+
+import (
+	"bread/config"
+	"bread/db"
+	"bread/session"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The administration server, nil when it is not running
+var server *http.Server
+
+// Download a consistent snapshot of the running database
+func Backup(w http.ResponseWriter, req *http.Request) {
+
+	if config.DbDriver != "sqlite3" {
+		http.Error(w, "Backups are only supported for sqlite3", http.StatusNotImplemented)
+		return
+	}
+
+	// Backup into a temporary file
+	tmpfile, err := ioutil.TempFile("", "bread-backup")
+	if err != nil {
+		log.Println("Cannot create backup file: ", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	err = db.Backup(config.DbSource, tmpfile.Name())
+	if err != nil {
+		log.Println("Backup failed: ", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
+	}
+
+	name := "bread-" + time.Now().Format("20060102-150405") + ".db"
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	http.ServeFile(w, req, tmpfile.Name())
+}
+
+// Report the statistics of the session cache as JSON
+func Stats(w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": session.CacheStats()})
+	if err != nil {
+		log.Println("Encoding stats: ", err)
+	}
+}
+
+// Start serving administration requests if there is an address for them
+func Start() {
+	if config.AdminAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backup", Backup)
+	mux.HandleFunc("/admin/stats", Stats)
+	server = &http.Server{Addr: config.AdminAddr, Handler: mux}
+
+	log.Println("Serving administration requests on", config.AdminAddr)
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal("Admin ListenAndServe: ", err)
+		}
+	}()
+}
+
+// Stop serving administration requests once the current ones complete
+func Stop(ctx context.Context) {
+	if server == nil {
+		return
+	}
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("Admin server shutdown: ", err)
+	}
+}
@@ -0,0 +1,141 @@
+/*
+ * A JSON interface to bread
+ */
+
+package api
+
+import (
+	"bread/pages"
+	"bread/session"
+	"bread/story"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// A story as returned by the API
+type Story struct {
+	Id       int64  `json:"id"`
+	Title    string `json:"title"`
+	Link     string `json:"link"`
+	Comments string `json:"comments"`
+}
+
+// A story found by a search
+type SearchResult struct {
+	Story
+	Relevance float64 `json:"relevance"`
+	Interest  float64 `json:"interest"`
+	Score     float64 `json:"score"`
+}
+
+// A page of search results
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Page    int            `json:"page"`
+	More    bool           `json:"more"`
+	Results []SearchResult `json:"results"`
+}
+
+// Convert a story for output
+func fromStory(s *story.Story) Story {
+	return Story{
+		Id:       s.Id,
+		Title:    s.Rss.Title,
+		Link:     s.Rss.Link,
+		Comments: s.Rss.Comments}
+}
+
+// Write the given value as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Encoding JSON: ", err)
+	}
+}
+
+// List, add or delete the filter rules of a user. Rules are added by
+// posting a rule and deleted by index.
+func Rules(w http.ResponseWriter, req *http.Request) {
+
+	var rules []session.Rule
+	var err error
+	switch req.Method {
+	case "GET":
+		rules, err = session.Rules(w, req)
+	case "POST":
+		var r session.Rule
+		err = json.NewDecoder(req.Body).Decode(&r)
+		if err == nil {
+			rules, err = session.AddRule(w, req, r)
+		}
+	case "DELETE":
+		var index int
+		_, err = fmt.Sscan(req.URL.Query().Get("id"), &index)
+		if err == nil {
+			rules, err = session.DeleteRule(w, req, index)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, rules)
+}
+
+// The number of recommended stories returned
+const recommendations = 10
+
+// Get stories read by users who read the same stories as the user
+func Recommended(w http.ResponseWriter, req *http.Request) {
+
+	recommended, ok := session.Recommended(w, req, recommendations)
+	if !ok {
+		return
+	}
+
+	ret := make([]Story, 0, len(recommended))
+	for _, s := range recommended {
+		ret = append(ret, fromStory(s))
+	}
+
+	writeJSON(w, ret)
+}
+
+// Search all stories
+func Search(w http.ResponseWriter, req *http.Request) {
+
+	page, query := pages.PageAndQuery(req)
+
+	// Request the search results
+	index, ok := session.Search(w, req, query, page)
+	if !ok {
+		return
+	}
+
+	ret := SearchPage{
+		Query:   query,
+		Page:    page,
+		More:    index.HaveNext,
+		Results: make([]SearchResult, 0, len(index.Results))}
+
+	for _, r := range index.Results {
+		ret.Results = append(ret.Results, SearchResult{
+			Story:     fromStory(r.Story),
+			Relevance: r.Relevance,
+			Interest:  r.Interest,
+			Score:     r.Score})
+	}
+
+	writeJSON(w, ret)
+}
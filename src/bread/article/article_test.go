@@ -0,0 +1,120 @@
+package article
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	f, err := os.Open("testdata/story.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	text := Extract(f)
+
+	for _, want := range []string{"returns it to the allocator", "garbage — it can be swept", "nursery often", "write barriers"} {
+		if !strings.Contains(text, want) {
+			t.Error("Article text missing", want, ":", text)
+		}
+	}
+
+	for _, unwanted := range []string{"newsletter", "Copyright", "tracking", "color", "Home"} {
+		if strings.Contains(text, unwanted) {
+			t.Error("Article text contains", unwanted, ":", text)
+		}
+	}
+}
+
+func TestExtractWithoutParagraphs(t *testing.T) {
+	f, err := os.Open("testdata/plain.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if text := Extract(f); text != "Short page with no paragraphs" {
+		t.Error("Page without paragraphs gave", text)
+	}
+}
+
+func TestTerms(t *testing.T) {
+	terms := Terms("collectors mark objects, collectors sweep objects, collectors", 2)
+	if len(terms) != 2 || terms[0] != "collectors" || terms[1] != "objects" {
+		t.Error("Wrong terms:", terms)
+	}
+}
+
+func TestFetchLocal(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	if _, err := fetch(server.URL + "/story.html"); err == nil {
+		t.Error("Fetched an article from the loopback address")
+	}
+
+	// Redirects are checked too
+	redirect := httptest.NewServer(http.RedirectHandler("http://127.0.0.1:1/", http.StatusFound))
+	defer redirect.Close()
+
+	defer func(d func(net.IP) bool) { dialable = d }(dialable)
+	first := true
+	dialable = func(ip net.IP) bool {
+		ret := first
+		first = false
+		return ret
+	}
+
+	if _, err := fetch(redirect.URL); err == nil || !strings.Contains(err.Error(), "not fetching") {
+		t.Error("Followed a redirect to the loopback address:", err)
+	}
+
+	for _, ip := range []string{"127.0.0.1", "::1", "::", "10.1.2.3", "192.168.0.1", "169.254.169.254",
+		"0.0.0.0", "0.1.2.3", "100.64.0.1", "224.0.0.1", "255.255.255.255", "::ffff:127.0.0.1",
+		"::ffff:10.1.2.3", "64:ff9b::a01:203", "2002:a01:203::1", "fe80::1", "fd00::1", "ff02::1"} {
+		if public(net.ParseIP(ip)) {
+			t.Error(ip, "is public")
+		}
+	}
+
+	for _, ip := range []string{"93.184.216.34", "::ffff:93.184.216.34", "2606:2800:220:1::1"} {
+		if !public(net.ParseIP(ip)) {
+			t.Error("Internet address", ip, "is not public")
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	// The fixture server is on the loopback address
+	defer func(d func(net.IP) bool) { dialable = d }(dialable)
+	dialable = func(net.IP) bool { return true }
+
+	text, err := fetch(server.URL + "/story.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "write barriers") {
+		t.Error("Fetched article text missing:", text)
+	}
+
+	terms := Terms(text, maxTerms)
+	if len(terms) == 0 || terms[0] != "collectors" {
+		t.Error("Fetched article has wrong terms:", terms)
+	}
+
+	if _, err := fetch(server.URL + "/missing.html"); err == nil {
+		t.Error("Fetched a missing page")
+	}
+
+	if _, err := fetch("ftp://example.com/story.html"); err == nil {
+		t.Error("Fetched a link that is not a web link")
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * Extracts the readable text of articles and the terms used to classify
+ * them
+ */
+
+package article
+
+import (
+	"bread/nbc"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The most terms of an article that are used to classify its story
+const maxTerms = 20
+
+// Paragraphs shorter than this are not scored
+const minParagraph = 25
+
+// Elements whose contents are removed before the page is parsed
+var scripts = regexp.MustCompile(`(?is)<script\b.*?</script\s*>|<style\b.*?</style\s*>|<!--.*?-->`)
+
+// Elements that never hold the text of an article
+var skipped = map[string]bool{
+	"head": true, "nav": true, "header": true, "footer": true, "aside": true,
+	"form": true, "noscript": true, "iframe": true, "svg": true, "button": true,
+	"select": true, "textarea": true, "template": true}
+
+// Elements that have no end tag
+var void = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true}
+
+// Elements that hold a paragraph of text
+var paragraph = map[string]bool{"p": true, "pre": true}
+
+// An element of the page
+type node struct {
+	name   string
+	parent *node
+	first  int     // The index of its first paragraph
+	last   int     // The index after its last paragraph
+	score  float64 // How likely the element holds the article
+	text   []string
+}
+
+// The state of the extraction of a page
+type extractor struct {
+	stack      []*node
+	skip       int      // The number of skipped elements on the stack
+	paragraphs []string // The scored paragraphs in page order
+	body       []string // All the text that is not skipped
+	best       *node
+}
+
+// Get the innermost open paragraph
+func (e *extractor) openParagraph() *node {
+	for i := len(e.stack) - 1; i >= 0; i-- {
+		if paragraph[e.stack[i].name] {
+			return e.stack[i]
+		}
+	}
+
+	return nil
+}
+
+// Open an element
+func (e *extractor) push(name string) {
+
+	// Paragraphs cannot nest, a new one closes the last
+	if paragraph[name] && e.openParagraph() != nil {
+		e.pop(e.openParagraph().name)
+	}
+
+	var parent *node
+	if len(e.stack) > 0 {
+		parent = e.stack[len(e.stack)-1]
+	}
+
+	e.stack = append(e.stack, &node{name: name, parent: parent, first: len(e.paragraphs)})
+	if skipped[name] {
+		e.skip++
+	}
+}
+
+// Close the innermost open element with the given name and any elements
+// opened within it. End tags without an open element are ignored.
+func (e *extractor) pop(name string) {
+	i := len(e.stack) - 1
+	for i >= 0 && e.stack[i].name != name {
+		i--
+	}
+	if i < 0 {
+		return
+	}
+
+	for j := len(e.stack) - 1; j >= i; j-- {
+		n := e.stack[j]
+		if skipped[n.name] {
+			e.skip--
+		}
+		if paragraph[n.name] {
+			e.score(n)
+		}
+		n.last = len(e.paragraphs)
+	}
+
+	e.stack = e.stack[:i]
+}
+
+// Score the elements that hold a paragraph, its parent gets the score and
+// its grandparent half the score
+func (e *extractor) score(p *node) {
+	text := strings.Join(p.text, " ")
+	if len(text) < minParagraph {
+		return
+	}
+
+	e.paragraphs = append(e.paragraphs, text)
+
+	score := 1 + float64(strings.Count(text, ","))
+	if l := float64(len(text)) / 100; l < 3 {
+		score += l
+	} else {
+		score += 3
+	}
+
+	if parent := p.parent; parent != nil {
+		parent.score += score
+		e.consider(parent)
+
+		if grandparent := parent.parent; grandparent != nil {
+			grandparent.score += score / 2
+			e.consider(grandparent)
+		}
+	}
+}
+
+// Remember the element with the highest score
+func (e *extractor) consider(n *node) {
+	if e.best == nil || n.score > e.best.score {
+		e.best = n
+	}
+}
+
+// Add text to the open paragraph and the body
+func (e *extractor) text(t string) {
+	if e.skip > 0 {
+		return
+	}
+
+	words := strings.Fields(t)
+	if len(words) == 0 {
+		return
+	}
+	t = strings.Join(words, " ")
+
+	e.body = append(e.body, t)
+	if p := e.openParagraph(); p != nil {
+		p.text = append(p.text, t)
+	}
+}
+
+// Extract the readable text of an HTML page, the paragraphs of the element
+// that holds the most text. Pages without paragraphs give all their text.
+func Extract(r io.Reader) string {
+	page, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ""
+	}
+	page = scripts.ReplaceAll(page, nil)
+
+	d := xml.NewDecoder(strings.NewReader(string(page)))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	e := new(extractor)
+
+	// Parse until the end of the page or the first error
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			break
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if name := strings.ToLower(t.Name.Local); !void[name] {
+				e.push(name)
+			}
+		case xml.EndElement:
+			e.pop(strings.ToLower(t.Name.Local))
+		case xml.CharData:
+			e.text(string(t))
+		}
+	}
+
+	// Close any elements left open
+	if len(e.stack) > 0 {
+		e.pop(e.stack[0].name)
+	}
+
+	if e.best == nil {
+		return strings.Join(e.body, " ")
+	}
+
+	return strings.Join(e.paragraphs[e.best.first:e.best.last], "\n\n")
+}
+
+// Get the terms of an article, its most frequent words
+func Terms(text string, n int) []string {
+	count := make(map[string]int)
+	for _, w := range nbc.Wordlist(strings.Join(strings.Fields(text), " ")) {
+		count[w]++
+	}
+
+	ret := make([]string, 0, len(count))
+	for w := range count {
+		ret = append(ret, w)
+	}
+
+	// Most frequent first, then alphabetically
+	sort.Slice(ret, func(i, j int) bool {
+		if count[ret[i]] != count[ret[j]] {
+			return count[ret[i]] > count[ret[j]]
+		}
+		return ret[i] < ret[j]
+	})
+
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+
+	return ret
+}
@@ -0,0 +1,214 @@
+package article
+
+// Fetches the article each new story links to in the background
+
+import (
+	"bread/config"
+	"bread/db"
+	"bread/session"
+	"bread/story"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The most of a page that is read
+const maxPage = 2 << 20
+
+// The most of an article's text that is stored
+const maxText = 64 << 10
+
+// How long fetching a page may take
+const fetchTimeout = 30 * time.Second
+
+// Indicates if articles can be fetched from an address, replaced by tests
+var dialable = public
+
+// Connections are checked after the host is resolved, including those
+// made to follow redirects. Proxies would bypass the check so none are
+// used.
+var dialer = &net.Dialer{Timeout: fetchTimeout, Control: checkAddress}
+var client = http.Client{
+	Timeout:   fetchTimeout,
+	Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+var fetchCh = make(chan *story.Story, 256)
+var stopCh = make(chan chan bool)
+
+// Indicates that the fetcher is running
+var running bool
+
+// Address blocks that are not on the internet or reach other networks
+// through it, from the IANA special-purpose address registries. IPv4-mapped
+// IPv6 addresses are parsed as IPv4 addresses so the IPv4 blocks cover them.
+var special = parseNets(
+	// IPv4
+	"0.0.0.0/8",       // This network
+	"10.0.0.0/8",      // Private
+	"100.64.0.0/10",   // Shared address space (CGNAT)
+	"127.0.0.0/8",     // Loopback
+	"169.254.0.0/16",  // Link local
+	"172.16.0.0/12",   // Private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation
+	"192.31.196.0/24", // AS112
+	"192.52.193.0/24", // AMT
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // Private
+	"192.175.48.0/24", // AS112
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation
+	"203.0.113.0/24",  // Documentation
+	"224.0.0.0/4",     // Multicast
+	"240.0.0.0/4",     // Reserved and broadcast
+
+	// IPv6
+	"::/96",          // Unspecified, loopback and IPv4-compatible
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"64:ff9b:1::/48", // Local IPv4/IPv6 translation
+	"100::/64",       // Discard only
+	"2001::/23",      // IETF protocol assignments, including Teredo
+	"2001:db8::/32",  // Documentation
+	"2002::/16",      // 6to4
+	"3fff::/20",      // Documentation
+	"5f00::/16",      // Segment routing
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link local
+	"fec0::/10",      // Site local
+	"ff00::/8")       // Multicast
+
+// Parse address blocks in CIDR notation
+func parseNets(cidrs ...string) []*net.IPNet {
+	ret := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, n)
+	}
+
+	return ret
+}
+
+// Indicate if an address is on the internet rather than the server itself,
+// its networks or any other special purpose block
+func public(ip net.IP) bool {
+	for _, n := range special {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Refuse to connect to addresses that articles cannot be fetched from
+func checkAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !dialable(ip) {
+		return errors.New("not fetching from " + host)
+	}
+
+	return nil
+}
+
+// Fetch the page at a link and extract its text
+func fetch(link string) (string, error) {
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		return "", errors.New("not a web link")
+	}
+
+	res, err := client.Get(link)
+	if err != nil {
+		return "", err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New(res.Status)
+	}
+
+	if ct := res.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return "", errors.New("not a web page: " + ct)
+	}
+
+	text := Extract(io.LimitReader(res.Body, maxPage))
+	if len(text) > maxText {
+		text = strings.ToValidUTF8(text[:maxText], "")
+	}
+
+	return text, nil
+}
+
+// Fetch the article of a story and classify the story with its terms
+func fetchStory(s *story.Story) {
+	text, err := fetch(s.Rss.Link)
+	if err != nil {
+		config.Debug("Cannot fetch article of story", s.Id, ":", err)
+		return
+	}
+
+	terms := Terms(text, maxTerms)
+	db.SetArticle(s.Id, text, terms)
+	session.AddTerms(s.Id, terms)
+}
+
+// Queue the article of a story to be fetched. Stories are dropped when the
+// queue is full.
+func Fetch(s *story.Story) {
+	if !running {
+		return
+	}
+
+	select {
+	case fetchCh <- s:
+	default:
+		config.Debug("Article queue full, not fetching story", s.Id)
+	}
+}
+
+// The fetcher function that is run within a go routine
+func fetcher() {
+	for {
+		select {
+		case s := <-fetchCh:
+			fetchStory(s)
+		case done := <-stopCh:
+			done <- true
+			return
+		}
+	}
+}
+
+// Stop the fetching go routine once the current article has been fetched
+func Stop() {
+	if !running {
+		return
+	}
+
+	done := make(chan bool)
+	stopCh <- done
+	<-done
+}
+
+// Start the fetching go routine if articles are fetched
+func Start() {
+	if config.FetchArticles && !config.Standalone {
+		running = true
+		go fetcher()
+	} else if config.FetchArticles {
+		log.Println("Not fetching articles in standalone mode")
+	}
+}
@@ -1,25 +1,116 @@
 package main
 
 import (
+	"bread/admin"
+	"bread/api"
+	"bread/article"
 	"bread/config"
 	"bread/db"
 	"bread/index"
 	"bread/pages"
+	"bread/recommend"
+	"bread/retention"
 	"bread/session"
+	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 )
 
+// The time allowed for requests to complete when stopping
+const shutdownTimeout = 10 * time.Second
+
+// The number of recommendations evaluated
+const evaluationSize = 10
+
+// Evaluate recommendations against the read history in the db
+func evaluate() {
+	db.Start()
+	defer db.Close()
+
+	e := recommend.Evaluate(db.GetReads(0), evaluationSize)
+	log.Printf("Recommending %d stories to %d users: %d hits (%.3f), popular stories %d hits (%.3f)",
+		evaluationSize, e.Users, e.Hits, e.HitRate, e.PopularHits, e.PopularHitRate)
+}
+
+// Run a command given on the command line
+func command(args []string) {
+	if len(args) == 1 && args[0] == "evaluate" {
+		evaluate()
+		return
+	}
+
+	if len(args) != 2 || (args[0] != "backup" && args[0] != "restore") {
+		log.Fatal("Usage: bread [flags] backup|restore <file> | evaluate")
+	}
+
+	if config.DbDriver != "sqlite3" {
+		log.Fatal("Backup and restore are only supported for sqlite3")
+	}
+
+	var err error
+	if args[0] == "backup" {
+		err = db.Backup(config.DbSource, args[1])
+	} else {
+		err = db.Restore(args[1], config.DbSource)
+	}
+
+	if err != nil {
+		log.Fatal("Cannot ", args[0], " ", args[1], ": ", err)
+	}
+}
+
+// Stop the server cleanly when it is signalled
+func stopOnSignal(server *http.Server, stopped chan bool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	log.Println("Stopping on", sig)
+
+	// Stop accepting requests and wait for the current ones to complete
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("HTTP server shutdown: ", err)
+	}
+	admin.Stop(ctx)
+
+	// Drain the background go routines and copy back sessions before
+	// closing the db
+	index.Stop()
+	article.Stop()
+	session.Stop()
+	db.Close()
+
+	stopped <- true
+}
+
 func main() {
 	// Get configuration
 	config.Init()
 
+	// Run a command instead of the server if one is given
+	if flag.NArg() > 0 {
+		command(flag.Args())
+		return
+	}
+
 	// Initialise packages
 	db.Start()
 	session.Start()
+	article.Start()
 	index.Start()
 	pages.Start()
+	retention.Start()
+	recommend.Start()
+	admin.Start()
 
 	// Setup HTTP server
 	log.Println("Starting HTTP server")
@@ -28,15 +119,37 @@ func main() {
 	http.HandleFunc("/read", pages.Read)
 	http.HandleFunc("/readagain", pages.ReadAgain)
 	http.HandleFunc("/comments", pages.Comments)
+	http.HandleFunc("/story", pages.Story)
+	http.HandleFunc("/story/vote", pages.Vote)
 	http.HandleFunc("/next", pages.Next)
 	http.HandleFunc("/prev", pages.Previous)
 	http.HandleFunc("/static/", pages.Static)
 	http.HandleFunc("/haveread", pages.HaveRead)
+	http.HandleFunc("/save", pages.Save)
+	http.HandleFunc("/unsave", pages.Unsave)
+	http.HandleFunc("/saved", pages.Saved)
 	http.HandleFunc("/profile", pages.Profile)
+	http.HandleFunc("/profile/reset", pages.ResetProfile)
+	http.HandleFunc("/profile/export", pages.ExportProfile)
+	http.HandleFunc("/profile/import", pages.ImportProfile)
+	http.HandleFunc("/profile/word", pages.EditWord)
+	http.HandleFunc("/profile/rule", pages.EditRule)
+	http.HandleFunc("/profile/decay", pages.EditDecay)
+	http.HandleFunc("/search", pages.Search)
+	http.HandleFunc("/api/search", api.Search)
+	http.HandleFunc("/api/rules", api.Rules)
+	http.HandleFunc("/api/recommended", api.Recommended)
 
 	// Start the HTTP Server
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
+	server := &http.Server{Addr: ":8080"}
+	stopped := make(chan bool)
+	go stopOnSignal(server, stopped)
+
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+
+	<-stopped
+	log.Println("Stopped")
 }
@@ -0,0 +1,101 @@
+/*
+ * Clusters stories that link to the same article or have nearly the same
+ * title
+ */
+
+package cluster
+
+import (
+	"bread/link"
+)
+
+// Titles at least this similar are the same story
+const similarTitles = 0.6
+
+// Titles with fewer words are only clustered by their link
+const minTitleWords = 3
+
+// A story that can be clustered with later stories
+type entry struct {
+	id      int64  // The id of the story
+	primary int64  // The id of the first story of its cluster
+	key     string // The key of the story's link
+	titled  bool   // Indicates if the story is clustered by its title
+	sig     Signature
+}
+
+// An index of recent stories that finds the cluster a new story belongs to
+type Index struct {
+	size    int               // The most stories that are kept
+	entries []*entry          // Stories oldest first
+	byKey   map[string]*entry // The first story with each link key
+}
+
+// Create an index of the given number of recent stories
+func New(size int) *Index {
+	return &Index{size: size, entries: make([]*entry, 0, size), byKey: make(map[string]*entry)}
+}
+
+// Add a story to the index. If it duplicates a recent story the id of the
+// first story in their cluster is returned.
+func (x *Index) Add(id int64, storyLink, title string) (int64, bool) {
+	e := &entry{id: id, primary: id, key: link.Key(storyLink)}
+
+	words := titleWords(title)
+	if len(words) >= minTitleWords {
+		e.titled = true
+		e.sig = sign(words)
+	}
+
+	dup := x.find(e)
+	if dup != nil {
+		e.primary = dup.primary
+	}
+
+	x.entries = append(x.entries, e)
+	if e.key != "" && x.byKey[e.key] == nil {
+		x.byKey[e.key] = e
+	}
+
+	// Forget the oldest story
+	if len(x.entries) > x.size {
+		old := x.entries[0]
+		if x.byKey[old.key] == old {
+			delete(x.byKey, old.key)
+		}
+		x.entries[0] = nil
+		x.entries = x.entries[1:]
+	}
+
+	return e.primary, dup != nil
+}
+
+// Find a recent story that the given story duplicates
+func (x *Index) find(e *entry) *entry {
+	if dup := x.byKey[e.key]; e.key != "" && dup != nil {
+		return dup
+	}
+
+	if !e.titled {
+		return nil
+	}
+
+	// The most similar title, newer stories win ties
+	var ret *entry
+	best := 0.0
+	for i := len(x.entries) - 1; i >= 0; i-- {
+		o := x.entries[i]
+		if !o.titled {
+			continue
+		}
+		if sim := e.sig.similarity(&o.sig); sim >= similarTitles && sim > best {
+			ret = o
+			best = sim
+			if sim == 1 {
+				break
+			}
+		}
+	}
+
+	return ret
+}
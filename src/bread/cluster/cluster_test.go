@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestSimilarity(t *testing.T) {
+	a := sign(titleWords("Think Hiring a Ruby Developer is Hard? Try Staffing a Nuclear Reactor Startup"))
+	b := sign(titleWords("Think hiring a Ruby developer is hard? Try staffing a nuclear reactor startup"))
+	c := sign(titleWords("Think Hiring a Ruby Developer is Hard? Try Staffing a Fusion Reactor Startup"))
+	d := sign(titleWords("Mathematics for Computer Science"))
+
+	if a.similarity(&b) != 1 {
+		t.Error("Titles that differ in case are not the same:", a.similarity(&b))
+	}
+
+	if sim := a.similarity(&c); sim < similarTitles || sim == 1 {
+		t.Error("Titles that differ by a word are not similar:", sim)
+	}
+
+	if sim := a.similarity(&d); sim >= similarTitles {
+		t.Error("Different titles are similar:", sim)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	x := New(3)
+
+	if _, dup := x.Add(1, "http://www.example.com/a?utm_source=rss", "Ask HN"); dup {
+		t.Error("First story is a duplicate")
+	}
+
+	// Links to the same article
+	if p, dup := x.Add(2, "https://example.com/a", "Something else entirely"); !dup || p != 1 {
+		t.Error("Same link not clustered:", p, dup)
+	}
+
+	// Resubmissions with a slightly different title
+	x.Add(3, "http://b.com/", "ISP storing 25 petabytes of Megaupload data costs it $9,000 a day")
+	if p, dup := x.Add(4, "http://c.com/", "ISP storing 25 petabytes of MegaUpload data costs $9,000 a day"); !dup || p != 3 {
+		t.Error("Similar title not clustered:", p, dup)
+	}
+
+	// Short titles are only clustered by link
+	if _, dup := x.Add(5, "http://d.com/", "Ask HN"); dup {
+		t.Error("Short title clustered")
+	}
+
+	// Old stories are forgotten
+	if _, dup := x.Add(6, "http://example.com/a", "Another title"); dup {
+		t.Error("Story clustered with a forgotten story")
+	}
+}
@@ -0,0 +1,96 @@
+package cluster
+
+// MinHash signatures of titles, the fraction of equal hashes in two
+// signatures estimates the Jaccard similarity of the titles' shingles
+
+import (
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// The number of hashes in a signature
+const numHashes = 64
+
+// A MinHash signature
+type Signature [numHashes]uint64
+
+// Seeds that make the hash functions of a signature differ
+var seeds = makeSeeds()
+
+// Mix the bits of a value, the splitmix64 finaliser
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Make a seed for each hash function
+func makeSeeds() [numHashes]uint64 {
+	var ret [numHashes]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range ret {
+		x += 0x9e3779b97f4a7c15
+		ret[i] = mix(x)
+	}
+
+	return ret
+}
+
+// Split a title into lowercase words without punctuation
+func titleWords(title string) []string {
+	return strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Get the shingles of a list of words, the words and each pair of
+// adjacent words
+func shingles(words []string) []string {
+	ret := make([]string, 0, 2*len(words))
+	for i, w := range words {
+		ret = append(ret, w)
+		if i > 0 {
+			ret = append(ret, words[i-1]+" "+w)
+		}
+	}
+
+	return ret
+}
+
+// Get the signature of a list of words
+func sign(words []string) Signature {
+	var ret Signature
+	for i := range ret {
+		ret[i] = ^uint64(0)
+	}
+
+	for _, s := range shingles(words) {
+		h := fnv.New64a()
+		h.Write([]byte(s))
+		sh := h.Sum64()
+
+		for i := range ret {
+			if v := mix(sh ^ seeds[i]); v < ret[i] {
+				ret[i] = v
+			}
+		}
+	}
+
+	return ret
+}
+
+// Estimate the similarity of the shingles of two signatures
+func (s *Signature) similarity(o *Signature) float64 {
+	equal := 0
+	for i := range s {
+		if s[i] == o[i] {
+			equal++
+		}
+	}
+
+	return float64(equal) / numHashes
+}
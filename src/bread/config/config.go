@@ -4,11 +4,40 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 // Global configuration
 var Standalone bool // Indicates that the server is not connected to the internet
 var Devmode bool    // Indicates that the server is in development mode
+var DbDriver string // The database driver, sqlite3 or postgres
+var DbSource string // The database filename or connection string
+
+// Write sessions to the database as soon as they change
+var WriteThrough bool
+
+// How long unknown session ids are remembered, 0 never remembers them
+var NotFoundTTL time.Duration
+
+// Train a classifier with the reads of all users for new users
+var GlobalClassifier bool
+
+// Fetch the article each story links to and classify with its text
+var FetchArticles bool
+
+// The address administration requests are served on, empty turns them off
+var AdminAddr string
+
+// Query parameters removed from links, those ending in * are prefixes
+var TrackingParams = strings.Split(defaultTrackingParams, ",")
+
+const defaultTrackingParams = "utm_*,fbclid,gclid,yclid,igshid,mc_cid,mc_eid,ref,ref_src,clicked,_hsenc,_hsmi"
+
+// Retention policy
+var StoryDays int     // Days to keep unread stories, 0 keeps them forever
+var SessionMonths int // Months to keep unused sessions, 0 keeps them forever
+var RetentionDry bool // Only report what the retention policy would remove
 
 // Logger for debug information
 var dbg = log.New(os.Stdout, "Debug: ", 0)
@@ -24,5 +53,18 @@ func Debug(v ...interface{}) {
 func Init() {
 	flag.BoolVar(&Standalone, "standalone", false, "Run the server without an internet connection.")
 	flag.BoolVar(&Devmode, "dev", false, "Run the server in development mode.")
+	flag.StringVar(&DbDriver, "db", "sqlite3", "The database driver, sqlite3 or postgres.")
+	flag.StringVar(&DbSource, "dbsource", "./db/bread.db", "The database filename or connection string.")
+	flag.BoolVar(&WriteThrough, "writethrough", false, "Write sessions to the database as soon as they change.")
+	flag.DurationVar(&NotFoundTTL, "notfoundttl", time.Minute, "How long unknown session ids are remembered, 0 never remembers them.")
+	flag.BoolVar(&GlobalClassifier, "globalclassifier", false, "Train a classifier with the reads of all users for new users.")
+	flag.BoolVar(&FetchArticles, "fetcharticles", false, "Fetch the article each story links to and classify with its text.")
+	flag.StringVar(&AdminAddr, "adminaddr", "127.0.0.1:8081", "The address administration requests are served on, empty turns them off.")
+	trackingParams := flag.String("trackingparams", defaultTrackingParams, "Comma separated query parameters removed from links, those ending in * are prefixes.")
+	flag.IntVar(&StoryDays, "storydays", 0, "Days to keep unread stories, 0 keeps them forever.")
+	flag.IntVar(&SessionMonths, "sessionmonths", 0, "Months to keep unused sessions, 0 keeps them forever.")
+	flag.BoolVar(&RetentionDry, "retentiondry", false, "Only log what the retention policy would remove.")
 	flag.Parse()
+
+	TrackingParams = strings.Split(*trackingParams, ",")
 }
@@ -0,0 +1,123 @@
+package db
+
+// Online backup and restore of SQLite databases
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+	"os"
+)
+
+// Open a connection to a SQLite database and pass the driver connection
+// to the given function
+func withSQLiteConn(filename string, f func(*sqlite3.SQLiteConn) error) error {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return errors.New("Not a SQLite connection")
+		}
+		return f(c)
+	})
+}
+
+// Copy the SQLite database src to dest with the online backup API. The copy
+// is a consistent snapshot even if src is in use.
+func copySQLite(src, dest string) error {
+
+	// Opening a missing source would create an empty database
+	_, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	return withSQLiteConn(src, func(srcConn *sqlite3.SQLiteConn) error {
+		return withSQLiteConn(dest, func(destConn *sqlite3.SQLiteConn) error {
+			backup, err := destConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+
+			// Copy all pages in one step so that nothing changes part way
+			_, err = backup.Step(-1)
+			if err != nil {
+				backup.Finish()
+				return err
+			}
+
+			return backup.Finish()
+		})
+	})
+}
+
+// Backup a SQLite database to the given file
+func Backup(filename, dest string) error {
+	return copySQLite(filename, dest)
+}
+
+// Check that a SQLite file is a bread database this server can use
+func validateSQLite(filename string) error {
+	_, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var check string
+	err = db.QueryRow("pragma integrity_check;").Scan(&check)
+	if err != nil {
+		return err
+	} else if check != "ok" {
+		return fmt.Errorf("%s failed the integrity check: %s", filename, check)
+	}
+
+	var tables int
+	err = db.QueryRow("select count(*) from sqlite_master" +
+		" where type = 'table' and name in ('story', 'session', 'read');").Scan(&tables)
+	if err != nil {
+		return err
+	} else if tables != 3 {
+		return fmt.Errorf("%s is not a bread database", filename)
+	}
+
+	var version int
+	err = db.QueryRow(sqlite.version).Scan(&version)
+	if err != nil {
+		return err
+	} else if version > len(sqlite.upgrades) {
+		return fmt.Errorf("%s has schema version %d, this server supports up to %d",
+			filename, version, len(sqlite.upgrades))
+	}
+
+	return nil
+}
+
+// Replace the SQLite database filename with the backup in src. The backup is
+// validated first, an older schema is upgraded when the server starts.
+func Restore(src, filename string) error {
+	err := validateSQLite(src)
+	if err != nil {
+		return err
+	}
+
+	return copySQLite(src, filename)
+}
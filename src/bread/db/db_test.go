@@ -0,0 +1,428 @@
+package db
+
+import (
+	"bread/rss"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create the tables in the given schema file
+func createSchema(t *testing.T, driver, source, schema string) {
+	b, err := ioutil.ReadFile(path.Join("../../../db", schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range strings.Split(string(b), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(schema, ": ", err)
+		}
+	}
+}
+
+// Run the same requests against any store
+func testStore(t *testing.T, s Store) {
+	defer s.Close()
+
+	// Stories
+	first := s.AddStory(&rss.Story{Id: "1HN", Title: "First story", Link: "http://a.com/1",
+		Summary: `<a href="http://a.com/fox" rel="nofollow">Fox</a> jumped`})
+	second := s.AddStory(&rss.Story{Id: "2HN", Title: "Second story", Link: "http://b.com/2?ref=rss",
+		Canonical: "http://b.com/2"})
+
+	if id, ok := s.SeenStory("1HN"); !ok || id != first {
+		t.Error("SeenStory did not find the first story:", id, ok)
+	}
+
+	if _, ok := s.SeenStory("3HN"); ok {
+		t.Error("SeenStory found a story that was never added")
+	}
+
+	latest := s.GetLatestStories(10)
+	if len(latest) != 2 || latest[0].Id != second || latest[1].Id != first {
+		t.Error("GetLatestStories returned the wrong stories:", latest)
+	}
+
+	if st := s.GetStory(second); st == nil || st.Rss.Title != "Second story" {
+		t.Error("GetStory returned the wrong story:", st)
+	}
+
+	if st := s.GetStory(second); st == nil || st.Rss.Link != "http://b.com/2?ref=rss" || st.Rss.Canonical != "http://b.com/2" {
+		t.Error("GetStory did not return the raw and canonical links:", st)
+	}
+
+	s.SetArticle(second, "The text of the second story", []string{"text", "second"})
+	if st := s.GetStory(second); st == nil || len(st.Terms) != 2 || st.Terms[1] != "second" {
+		t.Error("GetStory did not return the article terms:", st)
+	}
+
+	matches := s.SearchStories("story", 10)
+	if len(matches) != 2 {
+		t.Error("SearchStories did not find all matching stories:", matches)
+	}
+
+	matches = s.SearchStories("first a.com", 10)
+	if len(matches) != 1 || matches[0].Story.Id != first || matches[0].Relevance <= 0 {
+		t.Error("SearchStories returned the wrong match:", matches)
+	}
+
+	// The text of summaries is searched, not their markup
+	matches = s.SearchStories("fox", 10)
+	if len(matches) != 1 || matches[0].Story.Id != first || !strings.Contains(matches[0].Story.Rss.Summary, "<a") {
+		t.Error("SearchStories did not find the text of a summary:", matches)
+	}
+
+	if matches = s.SearchStories("nofollow", 10); len(matches) != 0 {
+		t.Error("SearchStories found the markup of a summary:", matches)
+	}
+
+	// Sessions
+	s.CreateSession(&Session{Id: "sess", Classifier: []byte{1}, HaveBrowsed: 1})
+	s.WriteSession(&Session{Id: "sess", Classifier: []byte{2}, HaveBrowsed: 2, Words: []byte{3}, Rules: []byte{4}})
+
+	sess, ok := s.GetSession("sess")
+	if !ok {
+		t.Error("GetSession did not find a created session")
+	} else if sess.HaveBrowsed != 2 || len(sess.Classifier) != 1 || sess.Classifier[0] != 2 {
+		t.Error("GetSession did not return the written session:", sess)
+	} else if len(sess.Words) != 1 || sess.Words[0] != 3 {
+		t.Error("GetSession did not return the written words:", sess.Words)
+	} else if len(sess.Rules) != 1 || sess.Rules[0] != 4 {
+		t.Error("GetSession did not return the written rules:", sess.Rules)
+	}
+
+	if _, ok := s.GetSession("unknown"); ok {
+		t.Error("GetSession found a session that was never created")
+	}
+
+	// Reads
+	s.MarkRead("sess", second)
+
+	read := s.GetRead("sess", first, second)
+	if len(read) != 1 || read[0] != second {
+		t.Error("GetRead returned the wrong stories:", read)
+	}
+
+	s.MarkRead("sess", first)
+
+	s.CreateSession(&Session{Id: "reader", Classifier: []byte{1}})
+	s.MarkRead("reader", second)
+
+	readers := s.GetReaders(first)
+	if len(readers) != 2 || readers[first] != 1 || readers[second] != 2 {
+		t.Error("GetReaders returned the wrong counts:", readers)
+	}
+
+	reads := s.GetReads(first)
+	if len(reads) != 2 || len(reads["sess"]) != 2 || reads["reader"][0] != second {
+		t.Error("GetReads returned the wrong reads:", reads)
+	}
+
+	readers = s.GetReaders(second + 1)
+	if len(readers) != 0 {
+		t.Error("GetReaders returned stories before the given story:", readers)
+	}
+
+	history := s.ReadHistory("sess", 0, 1)
+	if len(history) != 1 {
+		t.Error("ReadHistory did not limit the stories:", history)
+	}
+
+	history = s.ReadHistory("sess", 0, 10)
+	if len(history) != 2 {
+		t.Error("ReadHistory returned the wrong stories:", history)
+	}
+
+	found := s.SearchRead("sess", "second", 0, 10)
+	if len(found) != 1 || found[0].Id != second {
+		t.Error("SearchRead did not find a read title:", found)
+	}
+
+	found = s.SearchRead("sess", "b.com", 0, 10)
+	if len(found) != 1 || found[0].Id != second {
+		t.Error("SearchRead did not find a read host:", found)
+	}
+
+	found = s.SearchRead("other", "second", 0, 10)
+	if len(found) != 0 {
+		t.Error("SearchRead found stories read by another session:", found)
+	}
+
+	// Saved stories
+	s.SaveStory("sess", first)
+	s.SaveStory("sess", first)
+	s.SaveStory("sess", second)
+	s.UnsaveStory("sess", second)
+
+	saved := s.GetSaved("sess", first, second)
+	if len(saved) != 1 || saved[0] != first {
+		t.Error("GetSaved returned the wrong stories:", saved)
+	}
+
+	if ss := s.SavedStories("sess", 0, 10); len(ss) != 1 || ss[0].Id != first {
+		t.Error("SavedStories returned the wrong stories:", ss)
+	}
+
+	if ss := s.SavedStories("reader", 0, 10); len(ss) != 0 {
+		t.Error("SavedStories returned stories saved by another session:", ss)
+	}
+
+	// The global classifier
+	if _, ok := s.GetGlobalClassifier(); ok {
+		t.Error("Got a global classifier that was never written")
+	}
+
+	s.WriteGlobalClassifier([]byte{1})
+	s.WriteGlobalClassifier([]byte{2, 3})
+	if c, ok := s.GetGlobalClassifier(); !ok || string(c) != "\x02\x03" {
+		t.Error("GetGlobalClassifier returned the wrong classifier:", c, ok)
+	}
+}
+
+// Test the retention policy of any store
+func testRetention(t *testing.T, s Store) {
+	defer s.Close()
+
+	first := s.AddStory(&rss.Story{Id: "1HN", Title: "First story"})
+	second := s.AddStory(&rss.Story{Id: "2HN", Title: "Second story"})
+	third := s.AddStory(&rss.Story{Id: "3HN", Title: "Third story"})
+	s.CreateSession(&Session{Id: "sess"})
+	s.MarkRead("sess", second)
+	s.SaveStory("sess", third)
+
+	// Expire everything that can be expired
+	future := time.Now().Add(time.Hour).Unix()
+
+	// The latest stories are kept so that their ids have no gaps
+	if kept := s.Expire(future, 0, 3, true); kept.Stories != 0 {
+		t.Error("Latest stories would be removed:", kept)
+	}
+
+	dry := s.Expire(future, future, 1, true)
+	if dry.Stories < 1 || dry.Sessions != 1 {
+		t.Error("Dry run counted the wrong rows:", dry)
+	}
+
+	if s.GetStory(first) == nil {
+		t.Error("Dry run removed a story")
+	}
+
+	expired := s.Expire(future, future, 1, false)
+	if *expired != *dry {
+		t.Error("Expiry removed different rows to the dry run:", expired, dry)
+	}
+
+	if s.GetStory(first) != nil {
+		t.Error("Unread story was not removed")
+	}
+
+	if s.GetStory(second) == nil {
+		t.Error("Read story was removed")
+	}
+
+	if s.GetStory(third) == nil {
+		t.Error("Saved story was removed")
+	}
+
+	if _, ok := s.GetSession("sess"); ok {
+		t.Error("Unused session was not removed")
+	}
+
+	// What the removed session read and saved no longer keeps stories
+	if len(s.GetRead("sess", first, third)) != 0 || len(s.GetSaved("sess", first, third)) != 0 {
+		t.Error("Reads of a removed session were kept")
+	}
+
+	s.AddStory(&rss.Story{Id: "4HN", Title: "Fourth story"})
+	if expired := s.Expire(future, 0, 1, false); expired.Stories != 2 {
+		t.Error("Stories of a removed session were not removed:", expired)
+	}
+
+	// Stories that are still new are kept
+	s.AddStory(&rss.Story{Id: "5HN", Title: "Fifth story"})
+	past := time.Now().Add(-time.Hour).Unix()
+	if expired := s.Expire(past, 0, 1, false); expired.Stories != 0 {
+		t.Error("New stories were removed:", expired)
+	}
+
+	if len(s.SearchStories("first", 10)) != 0 {
+		t.Error("Removed story is still in the search index")
+	}
+}
+
+// Create a SQLite store in a temporary directory and run the given test
+func withSQLite(t *testing.T, test func(*testing.T, Store)) {
+	dir, err := ioutil.TempDir("", "bread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "bread.db")
+	createSchema(t, "sqlite3", filename, "bread.sql")
+	test(t, OpenSQLite(filename))
+}
+
+func TestSQLite(t *testing.T) {
+	withSQLite(t, testStore)
+	withSQLite(t, testRetention)
+}
+
+func TestPlainTextOfOldStories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A story added before the plain text of summaries was stored
+	filename := path.Join(dir, "bread.db")
+	createSchema(t, "sqlite3", filename, "bread.sql")
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("insert into story (providerid, title, summary, link, comments)" +
+		` values ('1HN', 'Old story', '<a href="http://a.com/fox" rel="nofollow">Fox</a>', 'http://a.com/1', '')`)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := OpenSQLite(filename)
+	defer s.Close()
+
+	if matches := s.SearchStories("fox", 10); len(matches) != 1 {
+		t.Error("SearchStories did not find the text of an old summary:", matches)
+	}
+
+	if matches := s.SearchStories("nofollow", 10); len(matches) != 0 {
+		t.Error("SearchStories found the markup of an old summary:", matches)
+	}
+}
+
+// Run a test against a PostgreSQL database emptied of any earlier test
+func withPostgres(t *testing.T, source string, test func(*testing.T, Store)) {
+	db, err := sql.Open("postgres", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("drop schema public cascade; create schema public")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createSchema(t, "postgres", source, "bread_postgres.sql")
+	test(t, OpenPostgres(source))
+}
+
+// Set BREAD_POSTGRES to the connection string of a database that can be
+// emptied to test against PostgreSQL
+func TestPostgres(t *testing.T) {
+	source := os.Getenv("BREAD_POSTGRES")
+	if source == "" {
+		t.Skip("BREAD_POSTGRES is not set")
+	}
+
+	withPostgres(t, source, testStore)
+	withPostgres(t, source, testRetention)
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := path.Join(dir, "bread.db")
+	backup := path.Join(dir, "backup.db")
+	restored := path.Join(dir, "restored.db")
+
+	// Backup a database that is in use
+	createSchema(t, "sqlite3", live, "bread.sql")
+	s := OpenSQLite(live)
+	id := s.AddStory(&rss.Story{Id: "1HN", Title: "First story"})
+
+	if err := Backup(live, backup); err != nil {
+		t.Fatal("Backup failed: ", err)
+	}
+	s.Close()
+
+	// Restore the backup
+	if err := Restore(backup, restored); err != nil {
+		t.Fatal("Restore failed: ", err)
+	}
+
+	s = OpenSQLite(restored)
+	if st := s.GetStory(id); st == nil || st.Rss.Title != "First story" {
+		t.Error("Restored database is missing a story: ", st)
+	}
+	s.Close()
+
+	// Backups that are not bread databases are refused
+	other := path.Join(dir, "other.db")
+	db, err := sql.Open("sqlite3", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("create table other(id);")
+	db.Close()
+
+	if err := Restore(other, restored); err == nil {
+		t.Error("Restored a database that is not a bread database")
+	}
+
+	if err := Restore(path.Join(dir, "missing.db"), restored); err == nil {
+		t.Error("Restored a missing database")
+	}
+
+	// Backups with a newer schema are refused
+	db, err = sql.Open("sqlite3", backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("pragma user_version = 1000;")
+	db.Close()
+
+	if err := Restore(backup, restored); err == nil {
+		t.Error("Restored a database with a newer schema")
+	}
+}
+
+func TestCloseCompletesWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := path.Join(dir, "bread.db")
+	createSchema(t, "sqlite3", filename, "bread.sql")
+
+	s := OpenSQLite(filename)
+	s.CreateSession(&Session{Id: "sess"})
+	s.Close()
+
+	s = OpenSQLite(filename)
+	defer s.Close()
+	if _, ok := s.GetSession("sess"); !ok {
+		t.Error("Queued write was lost when the store was closed")
+	}
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+)
+
+var postgresStatements = []statement{
+	{seenStory, "seenStory",
+		"select id from story where providerid = $1;"},
+	{addStory, "addStory",
+		"insert into story (providerid, title, summary, plaintext, link, canonical, comments, added)" +
+			" values ($1, $2, $3, $4, $5, $6, $7, $8) returning id;"},
+	{getLatestStories, "getLatestStories",
+		"select id, providerid, title, summary, link, canonical, comments, terms" +
+			" from story order by id desc limit $1"},
+	{createSession, "createSession",
+		"insert into session (id, classifier, ignored, browsed, classified, lastused, words, rules)" +
+			" values ($1, $2, $3, $4, $5, $6, $7, $8);"},
+	{updateSession, "updateSession",
+		"update session set classifier = $1, ignored = $2, browsed = $3, classified = $4," +
+			" lastused = $5, words = $6, rules = $7 where id = $8"},
+	{getSession, "getSession",
+		"select id, classifier, ignored, browsed, classified, words, rules" +
+			" from session where id = $1"},
+	{markRead, "markRead",
+		"insert into read (sessionid, storyid, readtime)" +
+			" values ($1, $2, $3);"},
+	{getRead, "getRead",
+		"select storyid from read" +
+			" where sessionid = $1 and storyid >= $2 and storyid <= $3"},
+	{getReaders, "getReaders",
+		"select storyid, count(*) from read" +
+			" where storyid >= $1 group by storyid"},
+	{getReads, "getReads",
+		"select sessionid, storyid from read" +
+			" where storyid >= $1 order by readtime, storyid"},
+	{readHistory, "readHistory",
+		"select story.id, providerid, title, summary, link, canonical, comments, terms" +
+			" from story, read" +
+			" where story.id = read.storyid and sessionid = $1" +
+			" order by readtime desc, storyid desc limit $2 offset $3"},
+	{searchRead, "searchRead",
+		"select story.id, providerid, title, summary, link, canonical, comments, terms" +
+			" from story, read" +
+			" where story.id = read.storyid and sessionid = $1" +
+			" and " + postgresText + " @@ plainto_tsquery('english', $2)" +
+			" order by ts_rank(" + postgresText + ", plainto_tsquery('english', $2)) desc" +
+			" limit $3 offset $4"},
+	{getStory, "getStory",
+		"select story.id, providerid, title, summary, link, canonical, comments, terms" +
+			" from story where story.id = $1"},
+	{searchStories, "searchStories",
+		"select id, providerid, title, summary, link, canonical, comments, terms," +
+			" ts_rank(" + postgresText + ", plainto_tsquery('english', $1)) as relevance" +
+			" from story" +
+			" where " + postgresText + " @@ plainto_tsquery('english', $1)" +
+			" order by relevance desc limit $2"},
+	{countExpiredStories, "countExpiredStories",
+		"select count(*) from story" +
+			" where added < $1 and id <= (select max(id) from story) - $2" +
+			" and not exists (select 1 from read where storyid = story.id)" +
+			" and not exists (select 1 from saved where storyid = story.id)"},
+	{expireStories, "expireStories",
+		"delete from story" +
+			" where added < $1 and id <= (select max(id) from story) - $2" +
+			" and not exists (select 1 from read where storyid = story.id)" +
+			" and not exists (select 1 from saved where storyid = story.id)"},
+	{countExpiredSessions, "countExpiredSessions",
+		"select count(*) from session where lastused < $1"},
+	{expireSessionReads, "expireSessionReads",
+		"delete from read where sessionid in" +
+			" (select id from session where lastused < $1)"},
+	{expireSessionSaved, "expireSessionSaved",
+		"delete from saved where sessionid in" +
+			" (select id from session where lastused < $1)"},
+	{expireSessions, "expireSessions",
+		"delete from session where lastused < $1"},
+	{setArticle, "setArticle",
+		"update story set article = $1, terms = $2 where id = $3"},
+	{saveStory, "saveStory",
+		"insert into saved (sessionid, storyid, savedtime)" +
+			" values ($1, $2, $3) on conflict do nothing;"},
+	{unsaveStory, "unsaveStory",
+		"delete from saved where sessionid = $1 and storyid = $2"},
+	{getSaved, "getSaved",
+		"select storyid from saved" +
+			" where sessionid = $1 and storyid >= $2 and storyid <= $3"},
+	{savedStories, "savedStories",
+		"select story.id, providerid, title, summary, link, canonical, comments, terms" +
+			" from story, saved" +
+			" where story.id = saved.storyid and sessionid = $1" +
+			" order by savedtime desc, storyid desc limit $2 offset $3"},
+	{getGlobalClassifier, "getGlobalClassifier",
+		"select classifier from globalclassifier where id = 1"},
+	{writeGlobalClassifier, "writeGlobalClassifier",
+		"insert into globalclassifier (id, classifier) values (1, $1)" +
+			" on conflict (id) do update set classifier = excluded.classifier"},
+	{unindexedStories, "unindexedStories",
+		"select id, summary from story where plaintext is null"},
+	{setPlainText, "setPlainText",
+		"update story set plaintext = $1 where id = $2"},
+	{analyze, "analyze",
+		"analyze"}}
+
+// The text of a story that is searched, this must match the storyfts index
+const postgresText = "to_tsvector('english', coalesce(title, '') || ' ' ||" +
+	" coalesce(plaintext, '') || ' ' || coalesce(substring(link from '://([^/]*)'), ''))"
+
+// The text of a story that was searched before the plain text of summaries
+// was stored
+const postgresMarkupText = "to_tsvector('english', coalesce(title, '') || ' ' ||" +
+	" coalesce(summary, '') || ' ' || coalesce(substring(link from '://([^/]*)'), ''))"
+
+// Scripts to upgrade the schema created by bread_postgres.sql
+var postgresUpgrades = []string{
+	// 1: Read times and a full text index of stories
+	"alter table read add column readtime bigint not null default 0;" +
+		" create index storyfts on story using gin (" + postgresMarkupText + ");" +
+		" update schemaversion set version = 1;",
+
+	// 2: Times used to expire stories and sessions
+	"alter table story add column added bigint not null default 0;" +
+		" alter table session add column lastused bigint not null default 0;" +
+		" update story set added = extract(epoch from now());" +
+		" update session set lastused = extract(epoch from now());" +
+		" update schemaversion set version = 2;",
+
+	// 3: Words users have pinned or blocked
+	"alter table session add column words bytea;" +
+		" update schemaversion set version = 3;",
+
+	// 4: Filter rules
+	"alter table session add column rules bytea;" +
+		" update schemaversion set version = 4;",
+
+	// 5: Canonical links, stories added before have none
+	"alter table story add column canonical text not null default '';" +
+		" update schemaversion set version = 5;",
+
+	// 6: Text and terms of the articles stories link to
+	"alter table story add column article text not null default '';" +
+		" alter table story add column terms text not null default '';" +
+		" update schemaversion set version = 6;",
+
+	// 7: Stories saved to read later
+	"create table saved (sessionid text not null, storyid bigint not null," +
+		"  savedtime bigint not null default 0);" +
+		" create unique index savedidx on saved(sessionid, storyid);" +
+		" update schemaversion set version = 7;",
+
+	// 8: The classifier trained by all users
+	"create table globalclassifier (id integer primary key, classifier bytea);" +
+		" update schemaversion set version = 8;",
+
+	// 9: The plain text of summaries is indexed rather than their markup,
+	// the server stores the plain text of older stories when it starts
+	"alter table story add column plaintext text;" +
+		" drop index storyfts;" +
+		" create index storyfts on story using gin (" + postgresText + ");" +
+		" update schemaversion set version = 9;"}
+
+var postgres = &dialect{
+	driver:     "postgres",
+	statements: postgresStatements,
+	insertId:   postgresInsertId,
+	matchQuery: func(query string) string { return query },
+	version:    "select version from schemaversion;",
+	upgrades:   postgresUpgrades}
+
+// Run an insert statement that returns the id of the new row
+// (lib/pq does not support LastInsertId)
+func postgresInsertId(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	var id int64
+	err := stmt.QueryRow(args...).Scan(&id)
+	return id, err
+}
+
+// Open a PostgreSQL database as a store. The source is a lib/pq connection
+// string e.g. "dbname=bread sslmode=disable". Only one bread server may
+// use the database at a time.
+func OpenPostgres(source string) Store {
+	return openSQL(postgres, source)
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+var sqliteStatements = []statement{
+	{seenStory, "seenStory",
+		"select ROWID from story where providerid = ?;"},
+	{addStory, "addStory",
+		"insert into story (providerid, title, summary, plaintext, link, canonical, comments, added)" +
+			" values (?,?,?,?,?,?,?,?);"},
+	{getLatestStories, "getLatestStories",
+		"select ROWID, providerid, title, summary, link, canonical, comments, terms" +
+			" from story order by ROWID desc limit ?"},
+	{createSession, "createSession",
+		"insert into session (id, classifier, ignored, browsed, classified, lastused, words, rules)" +
+			" values (?, ?, ?, ?, ?, ?, ?, ?);"},
+	{updateSession, "updateSession",
+		"update session set classifier = ?, ignored = ?, browsed = ?, classified = ?," +
+			" lastused = ?, words = ?, rules = ? where id = ?"},
+	{getSession, "getSession",
+		"select id, classifier, ignored, browsed, classified, words, rules" +
+			" from session where id = ?"},
+	{markRead, "markRead",
+		"insert into read (sessionid, storyid, readtime)" +
+			" values (?, ?, ?);"},
+	{getRead, "getRead",
+		"select storyid from read" +
+			" where sessionid = ? and storyid >= ? and storyid <= ?"},
+	{getReaders, "getReaders",
+		"select storyid, count(*) from read" +
+			" where storyid >= ? group by storyid"},
+	{getReads, "getReads",
+		"select sessionid, storyid from read" +
+			" where storyid >= ? order by readtime, storyid"},
+	{readHistory, "readHistory",
+		"select story.ROWID, providerid, title, summary, link, canonical, comments, terms" +
+			" from story, read" +
+			" where story.ROWID = read.storyid and sessionid = ?" +
+			" order by readtime desc, storyid desc limit ? offset ?"},
+	{searchRead, "searchRead",
+		"select story.ROWID, providerid, story.title, story.summary, link, canonical, comments, terms" +
+			" from storyfts, story, read" +
+			" where read.sessionid = ? and storyfts match ?" +
+			" and story.ROWID = storyfts.rowid and read.storyid = story.ROWID" +
+			" order by storyfts.rank limit ? offset ?"},
+	{getStory, "getStory",
+		"select story.ROWID, providerid, title, summary, link, canonical, comments, terms" +
+			" from story where story.ROWID = ?"},
+	{searchStories, "searchStories",
+		"select story.ROWID, providerid, story.title, story.summary, link, canonical, comments, terms," +
+			" -storyfts.rank" +
+			" from storyfts, story" +
+			" where storyfts match ? and story.ROWID = storyfts.rowid" +
+			" order by storyfts.rank limit ?"},
+	{countExpiredStories, "countExpiredStories",
+		"select count(*) from story" +
+			" where added < ? and ROWID <= (select max(ROWID) from story) - ?" +
+			" and ROWID not in (select storyid from read)" +
+			" and ROWID not in (select storyid from saved)"},
+	{expireStories, "expireStories",
+		"delete from story" +
+			" where added < ? and ROWID <= (select max(ROWID) from story) - ?" +
+			" and ROWID not in (select storyid from read)" +
+			" and ROWID not in (select storyid from saved)"},
+	{countExpiredSessions, "countExpiredSessions",
+		"select count(*) from session where lastused < ?"},
+	{expireSessionReads, "expireSessionReads",
+		"delete from read where sessionid in" +
+			" (select id from session where lastused < ?)"},
+	{expireSessionSaved, "expireSessionSaved",
+		"delete from saved where sessionid in" +
+			" (select id from session where lastused < ?)"},
+	{expireSessions, "expireSessions",
+		"delete from session where lastused < ?"},
+	{setArticle, "setArticle",
+		"update story set article = ?, terms = ? where ROWID = ?"},
+	{saveStory, "saveStory",
+		"insert or ignore into saved (sessionid, storyid, savedtime)" +
+			" values (?, ?, ?);"},
+	{unsaveStory, "unsaveStory",
+		"delete from saved where sessionid = ? and storyid = ?"},
+	{getSaved, "getSaved",
+		"select storyid from saved" +
+			" where sessionid = ? and storyid >= ? and storyid <= ?"},
+	{savedStories, "savedStories",
+		"select story.ROWID, providerid, title, summary, link, canonical, comments, terms" +
+			" from story, saved" +
+			" where story.ROWID = saved.storyid and sessionid = ?" +
+			" order by savedtime desc, storyid desc limit ? offset ?"},
+	{getGlobalClassifier, "getGlobalClassifier",
+		"select classifier from globalclassifier where id = 1"},
+	{writeGlobalClassifier, "writeGlobalClassifier",
+		"insert or replace into globalclassifier (id, classifier) values (1, ?)"},
+	{unindexedStories, "unindexedStories",
+		"select ROWID, summary from story where plaintext is null"},
+	{setPlainText, "setPlainText",
+		"update story set plaintext = ? where ROWID = ?"},
+	{analyze, "analyze",
+		"analyze"}}
+
+// SQL that extracts the host from the given link column
+func sqliteHost(link string) string {
+	rest := "substr(" + link + ", instr(" + link + ", '://') + 3)"
+	return "substr(" + rest + ", 1, instr(" + rest + " || '/', '/') - 1)"
+}
+
+// Scripts to upgrade the schema created by bread.sql
+var sqliteUpgrades = []string{
+	// 1: Read times and a full text index of stories
+	"alter table read add column readtime integer not null default 0;" +
+		" create virtual table storyfts using fts5(title, summary, host);" +
+		" create trigger storyftsinsert after insert on story begin" +
+		"  insert into storyfts (rowid, title, summary, host)" +
+		"   values (new.ROWID, new.title, new.summary, " + sqliteHost("new.link") + ");" +
+		" end;" +
+		" insert into storyfts (rowid, title, summary, host)" +
+		"  select ROWID, title, summary, " + sqliteHost("link") + " from story;" +
+		" pragma user_version = 1;",
+
+	// 2: Times used to expire stories and sessions
+	"alter table story add column added integer not null default 0;" +
+		" alter table session add column lastused integer not null default 0;" +
+		" update story set added = strftime('%s', 'now');" +
+		" update session set lastused = strftime('%s', 'now');" +
+		" create trigger storyftsdelete after delete on story begin" +
+		"  delete from storyfts where rowid = old.ROWID;" +
+		" end;" +
+		" pragma user_version = 2;",
+
+	// 3: Words users have pinned or blocked
+	"alter table session add column words blob;" +
+		" pragma user_version = 3;",
+
+	// 4: Filter rules
+	"alter table session add column rules blob;" +
+		" pragma user_version = 4;",
+
+	// 5: Canonical links, stories added before have none
+	"alter table story add column canonical text not null default '';" +
+		" pragma user_version = 5;",
+
+	// 6: Text and terms of the articles stories link to
+	"alter table story add column article text not null default '';" +
+		" alter table story add column terms text not null default '';" +
+		" pragma user_version = 6;",
+
+	// 7: Stories saved to read later
+	"create table saved (sessionid text not null, storyid integer not null," +
+		"  savedtime integer not null default 0);" +
+		" create unique index savedidx on saved(sessionid, storyid);" +
+		" pragma user_version = 7;",
+
+	// 8: The classifier trained by all users
+	"create table globalclassifier (id integer primary key, classifier blob);" +
+		" pragma user_version = 8;",
+
+	// 9: The plain text of summaries is indexed rather than their markup,
+	// the server stores the plain text of older stories when it starts
+	"alter table story add column plaintext text;" +
+		" drop trigger storyftsinsert;" +
+		" create trigger storyftsinsert after insert on story begin" +
+		"  insert into storyfts (rowid, title, summary, host)" +
+		"   values (new.ROWID, new.title, new.plaintext, " + sqliteHost("new.link") + ");" +
+		" end;" +
+		" create trigger storyftsupdate after update of plaintext on story begin" +
+		"  delete from storyfts where rowid = old.ROWID;" +
+		"  insert into storyfts (rowid, title, summary, host)" +
+		"   values (new.ROWID, new.title, new.plaintext, " + sqliteHost("new.link") + ");" +
+		" end;" +
+		" pragma user_version = 9;"}
+
+var sqlite = &dialect{
+	driver:     "sqlite3",
+	statements: sqliteStatements,
+	insertId:   sqliteInsertId,
+	matchQuery: sqliteMatchQuery,
+	version:    "pragma user_version;",
+	upgrades:   sqliteUpgrades}
+
+// Run an insert statement and return the ROWID of the new row
+func sqliteInsertId(stmt *sql.Stmt, args ...interface{}) (int64, error) {
+	result, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.LastInsertId()
+}
+
+// Quote each word of a search so that FTS5 query syntax is ignored
+func sqliteMatchQuery(query string) string {
+	words := strings.Fields(query)
+	for i, w := range words {
+		words[i] = `"` + strings.Replace(w, `"`, `""`, -1) + `"`
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Open a SQLite database file as a store
+func OpenSQLite(filename string) Store {
+	return openSQL(sqlite, filename)
+}
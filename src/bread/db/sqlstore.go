@@ -0,0 +1,1001 @@
+package db
+
+import (
+	"bread/rss"
+	"bread/story"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+)
+
+// Database queries and statements
+const (
+	seenStory = iota
+	addStory
+	getLatestStories
+	createSession
+	updateSession
+	getSession
+	markRead
+	getRead
+	getReaders
+	getReads
+	readHistory
+	searchRead
+	getStory
+	searchStories
+	countExpiredStories
+	expireStories
+	countExpiredSessions
+	expireSessionReads
+	expireSessionSaved
+	expireSessions
+	setArticle
+	saveStory
+	unsaveStory
+	getSaved
+	savedStories
+	getGlobalClassifier
+	writeGlobalClassifier
+	unindexedStories
+	setPlainText
+	analyze
+	numStatements
+)
+
+type statement struct {
+	id   int
+	name string
+	sql  string
+}
+
+// The differences between the SQL databases that can be used as a store
+type dialect struct {
+	driver     string      // The name of the database/sql driver
+	statements []statement // The statements written in this dialect
+
+	// Run an insert statement and return the id of the new row
+	insertId func(stmt *sql.Stmt, args ...interface{}) (int64, error)
+
+	// Convert a user's search into a full text query
+	matchQuery func(query string) string
+
+	// A query returning the version of the schema and the scripts that
+	// upgrade the schema from each version to the next
+	version  string
+	upgrades []string
+}
+
+// A request that reads something from the database
+type readReq struct {
+	stmt     int                         // The id of the statement to run
+	replyCh  chan interface{}            // A channel to send the results on
+	readRows func(*sql.Stmt) interface{} // Build a datastructure from the query result
+}
+
+// A request to write something to the database without returning data
+type writeReq struct {
+	stmt    int             // The id of the statement to run
+	replyCh chan bool       // A reply channel indicating success
+	write   func(*sql.Stmt) // Write to the db using the given statement
+}
+
+// A type that indicates if a story has been seen before
+type seen struct {
+	id       int64
+	haveSeen bool
+}
+
+// A type that holds a session and a success bool
+type sessionOK struct {
+	session *Session
+	ok      bool
+}
+
+// A store backed by a database/sql driver. Requests are serialised through
+// a single go routine that owns the prepared statements.
+type sqlStore struct {
+	dialect *dialect
+	readCh  chan *readReq  // Requests that return data
+	writeCh chan *writeReq // Requests that only write
+	closeCh chan chan bool // Requests to close the store
+}
+
+// Open a store using the given dialect and data source
+func openSQL(d *dialect, source string) *sqlStore {
+
+	// Open the DB
+	db, err := sql.Open(d.driver, source)
+	if err != nil {
+		log.Fatal("Cannot open ", source, ": ", err)
+	}
+
+	// Bring the schema up to date and setup database statements
+	upgrade(db, d)
+	statements := createStatements(db, d.statements)
+	indexPlainText(db, statements)
+
+	st := &sqlStore{
+		dialect: d,
+		readCh:  make(chan *readReq),
+		writeCh: make(chan *writeReq, 8),
+		closeCh: make(chan chan bool)}
+
+	go st.requests(db, statements)
+	return st
+}
+
+// Fufil db requests from the store channels
+func (st *sqlStore) requests(db *sql.DB, statements []*sql.Stmt) {
+
+	// Loop reading requests and executing DB statements
+	for {
+		select {
+		case rr := <-st.readCh:
+			// Complete queued writes so that reads see them
+			st.flushWrites(statements)
+			rr.replyCh <- rr.readRows(statements[rr.stmt])
+		case wr := <-st.writeCh:
+			wr.write(statements[wr.stmt])
+		case done := <-st.closeCh:
+			st.flushWrites(statements)
+			closeStatements(statements)
+			db.Close()
+			done <- true
+			return
+		}
+	}
+}
+
+// Execute any queued write requests without blocking
+func (st *sqlStore) flushWrites(statements []*sql.Stmt) {
+	for {
+		select {
+		case wr := <-st.writeCh:
+			wr.write(statements[wr.stmt])
+		default:
+			return
+		}
+	}
+}
+
+// Complete any queued writes and close the store
+func (st *sqlStore) Close() {
+	done := make(chan bool)
+	st.closeCh <- done
+	<-done
+}
+
+// Upgrade the schema of the given database to the latest version
+func upgrade(db *sql.DB, d *dialect) {
+	var version int
+	err := db.QueryRow(d.version).Scan(&version)
+	if err != nil {
+		log.Fatal("Cannot read schema version: ", err)
+	}
+
+	if version > len(d.upgrades) {
+		log.Fatal("Schema version ", version, " is newer than this server supports")
+	}
+
+	for ; version < len(d.upgrades); version++ {
+		log.Println("Upgrading database schema to version", version+1)
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Fatal("Cannot begin schema upgrade: ", err)
+		}
+
+		_, err = tx.Exec(d.upgrades[version])
+		if err != nil {
+			tx.Rollback()
+			log.Fatal("Cannot upgrade schema to version ", version+1, ": ", err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			log.Fatal("Cannot commit schema upgrade: ", err)
+		}
+	}
+}
+
+// Store the plain text of the summaries of stories added before the schema
+// had it, so that the full text index does not hold their markup
+func indexPlainText(db *sql.DB, statements []*sql.Stmt) {
+	rows, err := statements[unindexedStories].Query()
+	if err != nil {
+		log.Fatal("Cannot execute unindexedStories stmt: ", err)
+	}
+
+	var id int64
+	var summary string
+	text := make(map[int64]string)
+	for rows.Next() {
+		rows.Scan(&id, &summary)
+		text[id] = rss.PlainText(summary)
+	}
+	rows.Close()
+
+	if len(text) == 0 {
+		return
+	}
+
+	log.Println("Indexing the plain text of", len(text), "stories")
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal("Cannot begin indexing plain text: ", err)
+	}
+
+	stmt := tx.Stmt(statements[setPlainText])
+	for id, t := range text {
+		_, err = stmt.Exec(t, id)
+		if err != nil {
+			tx.Rollback()
+			log.Fatal("Cannot execute setPlainText stmt: ", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Fatal("Cannot commit plain text: ", err)
+	}
+}
+
+// Create statement handles
+func createStatements(db *sql.DB, defs []statement) []*sql.Stmt {
+	ret := make([]*sql.Stmt, numStatements)
+
+	for _, def := range defs {
+		sth, err := db.Prepare(def.sql)
+		if err != nil {
+			log.Fatal("Cannot prepare ", def.name, " statement: ", err)
+		}
+		ret[def.id] = sth
+	}
+
+	return ret
+}
+
+//  Close statement handles
+func closeStatements(statements []*sql.Stmt) {
+	for _, sth := range statements {
+		sth.Close()
+	}
+}
+
+// Indicate if the story with the given provider id has already been by this application
+func (st *sqlStore) SeenStory(providerid string) (int64, bool) {
+
+	rr := new(readReq)
+	rr.stmt = seenStory
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(providerid)
+
+		if err != nil {
+			log.Fatal("Cannot execute seenStory stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		found := false
+		for rows.Next() {
+			rows.Scan(&id)
+			found = true
+		}
+
+		if found {
+			return seen{id, true}
+		}
+
+		return seen{0, false}
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(seen)
+	if !ok {
+		log.Fatal("Returned seen struct failed type assertion")
+	}
+
+	return ret.id, ret.haveSeen
+}
+
+// Add a story to the database and return its storyid
+func (st *sqlStore) AddStory(s *rss.Story) int64 {
+
+	rr := new(readReq)
+	rr.stmt = addStory
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		id, err := st.dialect.insertId(stmt,
+			s.Id, s.Title, s.Summary, rss.PlainText(s.Summary), s.Link, s.Canonical, s.Comments,
+			time.Now().Unix())
+		if err != nil {
+			log.Fatal("Cannot execute addStory stmt: ", err)
+		}
+
+		return id
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(int64)
+	if !ok {
+		log.Fatal("Returned int64 failed type assertion")
+	}
+
+	return ret
+
+}
+
+// Read the latest stories
+func (st *sqlStore) GetLatestStories(numStories int) []*story.Story {
+
+	rr := new(readReq)
+	rr.stmt = getLatestStories
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(numStories)
+
+		if err != nil {
+			log.Fatal("Cannot execute getLatestStories stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		var terms string
+		r := rss.Story{}
+		stories := make([]*story.Story, 0, numStories)
+
+		for rows.Next() {
+			rows.Scan(&id, &r.Id, &r.Title, &r.Summary, &r.Link, &r.Canonical, &r.Comments, &terms)
+			story := story.FromRSS(id, &r).WithTerms(strings.Fields(terms))
+			stories = append(stories, story)
+		}
+
+		return stories
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.([]*story.Story)
+	if !ok {
+		log.Fatal("Returned []*story.Story failed type assertion")
+	}
+
+	return ret
+}
+
+// Get a session
+func (st *sqlStore) GetSession(sessionid string) (*Session, bool) {
+
+	rr := new(readReq)
+	rr.stmt = getSession
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		// TODO: swap to Query/RawBytes to save memcpy
+		rows, err := stmt.Query(sessionid)
+
+		if err != nil {
+			log.Fatal("Failed to execute getSession stmt: ", err)
+		}
+
+		defer rows.Close()
+
+		var id string
+		var classifier []byte
+		var ignored []byte
+		var browsed int64
+		var classified int64
+		var words []byte
+		var rules []byte
+		have_row := false
+		for rows.Next() {
+			rows.Scan(&id, &classifier, &ignored, &browsed, &classified, &words, &rules)
+			have_row = true
+		}
+
+		if have_row {
+			return sessionOK{
+				session: &Session{Id: id,
+					Classifier:     classifier,
+					HaveIgnored:    ignored,
+					HaveBrowsed:    browsed,
+					HaveClassified: classified,
+					Words:          words,
+					Rules:          rules},
+				ok: true}
+		}
+
+		return sessionOK{session: nil, ok: false}
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(sessionOK)
+	if !ok {
+		log.Fatal("Returned *Session failed type assertion")
+	}
+
+	return ret.session, ret.ok
+}
+
+// Create a session
+func (st *sqlStore) CreateSession(session *Session) {
+
+	wr := new(writeReq)
+	wr.stmt = createSession
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statement
+		_, err := stmt.Exec(
+			session.Id,
+			session.Classifier,
+			session.HaveIgnored,
+			session.HaveBrowsed,
+			session.HaveClassified,
+			time.Now().Unix(),
+			session.Words,
+			session.Rules)
+		if err != nil {
+			log.Fatal("Cannot execute createSession stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Write to an existing session
+func (st *sqlStore) WriteSession(session *Session) {
+
+	wr := new(writeReq)
+	wr.stmt = updateSession
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statement
+		_, err := stmt.Exec(
+			session.Classifier,
+			session.HaveIgnored,
+			session.HaveBrowsed,
+			session.HaveClassified,
+			time.Now().Unix(),
+			session.Words,
+			session.Rules,
+			session.Id)
+		if err != nil {
+			log.Fatal("Cannot execute updateSession stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Mark a story as read
+func (st *sqlStore) MarkRead(sessionid string, storyid int64) {
+
+	wr := new(writeReq)
+	wr.stmt = markRead
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statment
+		_, err := stmt.Exec(sessionid, storyid, time.Now().Unix())
+		if err != nil {
+			log.Println("Cannot execute markRead(", sessionid, ",", storyid, ") stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Store the text and terms of the article a story links to
+func (st *sqlStore) SetArticle(storyid int64, text string, terms []string) {
+
+	wr := new(writeReq)
+	wr.stmt = setArticle
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statment
+		_, err := stmt.Exec(text, strings.Join(terms, " "), storyid)
+		if err != nil {
+			log.Println("Cannot execute setArticle(", storyid, ") stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Get the number of sessions that have read each story from the given story on
+func (st *sqlStore) GetReaders(minid int64) map[int64]int {
+
+	rr := new(readReq)
+	rr.stmt = getReaders
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(minid)
+
+		if err != nil {
+			log.Fatal("Cannot execute getReaders stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		var readers int
+		ret := make(map[int64]int)
+
+		for rows.Next() {
+			rows.Scan(&id, &readers)
+			ret[id] = readers
+		}
+
+		return ret
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(map[int64]int)
+	if !ok {
+		log.Fatal("Returned map[int64]int failed type assertion")
+	}
+
+	return ret
+}
+
+// Get the stories every session has read from the given story on, in the
+// order they were read
+func (st *sqlStore) GetReads(minid int64) map[string][]int64 {
+
+	rr := new(readReq)
+	rr.stmt = getReads
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(minid)
+
+		if err != nil {
+			log.Fatal("Cannot execute getReads stmt: ", err)
+		}
+		defer rows.Close()
+
+		var sessionid string
+		var id int64
+		ret := make(map[string][]int64)
+
+		for rows.Next() {
+			rows.Scan(&sessionid, &id)
+			ret[sessionid] = append(ret[sessionid], id)
+		}
+
+		return ret
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(map[string][]int64)
+	if !ok {
+		log.Fatal("Returned map[string][]int64 failed type assertion")
+	}
+
+	return ret
+}
+
+// Get the read stories for a session
+func (st *sqlStore) GetRead(sessionid string, minid, maxid int64) []int64 {
+	return st.storyIds(getRead, "getRead", sessionid, minid, maxid)
+}
+
+// Save a story for a session to read later
+func (st *sqlStore) SaveStory(sessionid string, storyid int64) {
+
+	wr := new(writeReq)
+	wr.stmt = saveStory
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statment
+		_, err := stmt.Exec(sessionid, storyid, time.Now().Unix())
+		if err != nil {
+			log.Println("Cannot execute saveStory(", sessionid, ",", storyid, ") stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Remove a story from the stories a session saved
+func (st *sqlStore) UnsaveStory(sessionid string, storyid int64) {
+
+	wr := new(writeReq)
+	wr.stmt = unsaveStory
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statment
+		_, err := stmt.Exec(sessionid, storyid)
+		if err != nil {
+			log.Println("Cannot execute unsaveStory(", sessionid, ",", storyid, ") stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Get the saved stories for a session
+func (st *sqlStore) GetSaved(sessionid string, minid, maxid int64) []int64 {
+	return st.storyIds(getSaved, "getSaved", sessionid, minid, maxid)
+}
+
+// Get a page of the stories saved by a session, most recently saved first
+func (st *sqlStore) SavedStories(sessionid string, offset, limit int) []*story.Story {
+	return st.readStories(savedStories, "savedStories", limit, sessionid, limit, offset)
+}
+
+// Run a query that returns story ids
+func (st *sqlStore) storyIds(stmtid int, name string, args ...interface{}) []int64 {
+
+	rr := new(readReq)
+	rr.stmt = stmtid
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(args...)
+
+		if err != nil {
+			log.Fatal("Cannot execute ", name, " stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		read := make([]int64, 0, 8)
+
+		for rows.Next() {
+			rows.Scan(&id)
+			read = append(read, id)
+		}
+
+		return read
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.([]int64)
+	if !ok {
+		log.Fatal("Returned []int64 failed type assertion")
+	}
+
+	return ret
+}
+
+// Get a page of the stories read by a session, most recently read first
+func (st *sqlStore) ReadHistory(sessionid string, offset, limit int) []*story.Story {
+	return st.readStories(readHistory, "readHistory", limit, sessionid, limit, offset)
+}
+
+// Search the stories read by a session
+func (st *sqlStore) SearchRead(sessionid, query string, offset, limit int) []*story.Story {
+	return st.readStories(searchRead, "searchRead", limit,
+		sessionid, st.dialect.matchQuery(query), limit, offset)
+}
+
+// Run a query that returns at most n stories
+func (st *sqlStore) readStories(stmtid int, name string, n int, args ...interface{}) []*story.Story {
+
+	rr := new(readReq)
+	rr.stmt = stmtid
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(args...)
+
+		if err != nil {
+			log.Fatal("Cannot execute ", name, " stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		var terms string
+		r := rss.Story{}
+		stories := make([]*story.Story, 0, n)
+
+		for rows.Next() {
+			rows.Scan(&id, &r.Id, &r.Title, &r.Summary, &r.Link, &r.Canonical, &r.Comments, &terms)
+			story := story.FromRSS(id, &r).WithTerms(strings.Fields(terms))
+			stories = append(stories, story)
+		}
+
+		return stories
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.([]*story.Story)
+	if !ok {
+		log.Fatal("Returned []*story.Story failed type assertion")
+	}
+
+	return ret
+}
+
+// Get the story with the given id
+func (st *sqlStore) GetStory(storyid int64) *story.Story {
+
+	rr := new(readReq)
+	rr.stmt = getStory
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(storyid)
+
+		if err != nil {
+			log.Fatal("Cannot execute getStory stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		var terms string
+		var s *story.Story
+
+		r := rss.Story{}
+		for rows.Next() {
+			rows.Scan(&id, &r.Id, &r.Title, &r.Summary, &r.Link, &r.Canonical, &r.Comments, &terms)
+			s = story.FromRSS(id, &r).WithTerms(strings.Fields(terms))
+		}
+
+		return s
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(*story.Story)
+	if !ok {
+		log.Fatal("Returned *story.Story failed type assertion")
+	}
+
+	return ret
+}
+
+// Search all stories, the best matches are returned first
+func (st *sqlStore) SearchStories(query string, limit int) []*Match {
+
+	rr := new(readReq)
+	rr.stmt = searchStories
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		rows, err := stmt.Query(st.dialect.matchQuery(query), limit)
+
+		if err != nil {
+			log.Fatal("Cannot execute searchStories stmt: ", err)
+		}
+		defer rows.Close()
+
+		var id int64
+		var terms string
+		var relevance float64
+		r := rss.Story{}
+		matches := make([]*Match, 0, limit)
+
+		for rows.Next() {
+			rows.Scan(&id, &r.Id, &r.Title, &r.Summary, &r.Link, &r.Canonical, &r.Comments, &terms, &relevance)
+			m := &Match{Story: story.FromRSS(id, &r).WithTerms(strings.Fields(terms)), Relevance: relevance}
+			matches = append(matches, m)
+		}
+
+		return matches
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.([]*Match)
+	if !ok {
+		log.Fatal("Returned []*Match failed type assertion")
+	}
+
+	return ret
+}
+
+// Get the classifier trained by all users, if it has been written
+func (st *sqlStore) GetGlobalClassifier() ([]byte, bool) {
+
+	rr := new(readReq)
+	rr.stmt = getGlobalClassifier
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		var classifier []byte
+		err := stmt.QueryRow().Scan(&classifier)
+
+		if err == sql.ErrNoRows {
+			return []byte(nil)
+		}
+		if err != nil {
+			log.Fatal("Cannot execute getGlobalClassifier stmt: ", err)
+		}
+
+		return classifier
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.([]byte)
+	if !ok {
+		log.Fatal("Returned []byte failed type assertion")
+	}
+
+	return ret, ret != nil
+}
+
+// Write the classifier trained by all users
+func (st *sqlStore) WriteGlobalClassifier(classifier []byte) {
+
+	wr := new(writeReq)
+	wr.stmt = writeGlobalClassifier
+
+	wr.write = func(stmt *sql.Stmt) {
+
+		// Execute the statement
+		_, err := stmt.Exec(classifier)
+		if err != nil {
+			log.Println("Cannot execute writeGlobalClassifier stmt: ", err)
+		}
+	}
+
+	st.writeCh <- wr
+}
+
+// Remove unread stories added before storyTime and sessions last used before
+// sessionTime, a zero time keeps everything. The latest keepStories ids are
+// never removed. A dry run only counts the rows that would be removed.
+func (st *sqlStore) Expire(storyTime, sessionTime int64, keepStories int, dryRun bool) *Expired {
+	ret := new(Expired)
+
+	if storyTime > 0 {
+		if dryRun {
+			ret.Stories = st.count(countExpiredStories, "countExpiredStories", storyTime, keepStories)
+		} else {
+			ret.Stories = st.exec(expireStories, "expireStories", storyTime, keepStories)
+		}
+	}
+
+	if sessionTime > 0 {
+		if dryRun {
+			ret.Sessions = st.count(countExpiredSessions, "countExpiredSessions", sessionTime)
+		} else {
+			// Remove what the sessions read and saved first, so that
+			// the stories can expire
+			st.exec(expireSessionReads, "expireSessionReads", sessionTime)
+			st.exec(expireSessionSaved, "expireSessionSaved", sessionTime)
+			ret.Sessions = st.exec(expireSessions, "expireSessions", sessionTime)
+		}
+	}
+
+	// Update the statistics the query planner uses. SQLite is not vacuumed
+	// as that can renumber the story and session rows that other tables
+	// refer to, the space of removed rows is reused instead.
+	if ret.Stories+ret.Sessions > 0 && !dryRun {
+		st.exec(analyze, "analyze")
+	}
+
+	return ret
+}
+
+// Run a query that returns a single count
+func (st *sqlStore) count(stmtid int, name string, args ...interface{}) int64 {
+
+	rr := new(readReq)
+	rr.stmt = stmtid
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Run the query
+		var n int64
+		err := stmt.QueryRow(args...).Scan(&n)
+		if err != nil {
+			log.Fatal("Cannot execute ", name, " stmt: ", err)
+		}
+
+		return n
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(int64)
+	if !ok {
+		log.Fatal("Returned int64 failed type assertion")
+	}
+
+	return ret
+}
+
+// Execute a statement and return the number of rows affected
+func (st *sqlStore) exec(stmtid int, name string, args ...interface{}) int64 {
+
+	rr := new(readReq)
+	rr.stmt = stmtid
+	rr.replyCh = make(chan interface{})
+
+	rr.readRows = func(stmt *sql.Stmt) interface{} {
+
+		// Execute the statement
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			log.Fatal("Cannot execute ", name, " stmt: ", err)
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			log.Fatal("Error retrieving rows affected: ", err)
+		}
+
+		return n
+	}
+
+	st.readCh <- rr
+
+	// Wait for a reply
+	res := <-rr.replyCh
+	ret, ok := res.(int64)
+	if !ok {
+		log.Fatal("Returned int64 failed type assertion")
+	}
+
+	return ret
+}
@@ -1,8 +1,10 @@
 package index
 
 import (
+	"bread/article"
 	"bread/config"
 	"bread/db"
+	"bread/link"
 	"bread/rss"
 	"bread/session"
 	"bread/story"
@@ -12,9 +14,15 @@ import (
 
 const indexDir = "./index"
 
-var feedCh = make(chan string, 8)
+var feedCh = make(chan *Feed, 8)
+var stopCh = make(chan chan bool)
 
-func addStory(newStories []*story.Story, rs *rss.Story) []*story.Story {
+func addStory(newStories []*story.Story, rs *rss.Story, base string) []*story.Story {
+
+	// Store the raw link, resolved against the feed, and its canonical form
+	rs.Link = link.Resolve(base, rs.Link)
+	rs.Comments = link.Resolve(base, rs.Comments)
+	rs.Canonical = link.Canonical(rs.Link)
 
 	id, seen := db.SeenStory(rs.Id)
 	if seen {
@@ -28,39 +36,54 @@ func addStory(newStories []*story.Story, rs *rss.Story) []*story.Story {
 	return append(newStories, s)
 }
 
-func readFeed(filename string) {
-	config.Debug("Reading feed: ", filename)
+func readFeed(feed *Feed) {
+	config.Debug("Reading feed: ", feed.path)
 
-	stories, err := rss.Decode(filename)
+	stories, err := rss.Decode(feed.path)
 	if err != nil {
-		log.Println("Cannot decode ", filename, " :", err)
+		log.Println("Cannot decode ", feed.path, " :", err)
 		return
 	}
 
 	todo := make([]*story.Story, 0, 64)
 	for _, s := range stories {
-		todo = addStory(todo, s)
+		todo = addStory(todo, s, feed.url)
 	}
 
 	// Add any new stories
 	session.AddStories(todo)
+
+	// Fetch their articles
+	for _, s := range todo {
+		article.Fetch(s)
+	}
 }
 
-// Read the feed with the given filename
-func ReadFeed(filename string) {
-	feedCh <- filename
+// Read the file of the given feed
+func ReadFeed(feed *Feed) {
+	feedCh <- feed
 }
 
 // The indexer function that is run within a go routine
 func indexer() {
 	for {
 		select {
-		case file := <-feedCh:
-			readFeed(file)
+		case feed := <-feedCh:
+			readFeed(feed)
+		case done := <-stopCh:
+			done <- true
+			return
 		}
 	}
 }
 
+// Stop the indexing go routine once the current feed has been read
+func Stop() {
+	done := make(chan bool)
+	stopCh <- done
+	<-done
+}
+
 // Start the indexing go routine
 func Start() {
 	go indexer()
@@ -53,7 +53,7 @@ func pull(feed *Feed) {
 
 	// Only process local feeds if the server is not connected to the internet
 	if config.Standalone {
-		ReadFeed(feed.path)
+		ReadFeed(feed)
 		return
 	}
 
@@ -80,5 +80,5 @@ func pull(feed *Feed) {
 	os.Rename(tmpname, feed.path)
 
 	// Inform the indexer
-	ReadFeed(feed.path)
+	ReadFeed(feed)
 }
@@ -0,0 +1,108 @@
+/*
+ * Canonical forms of story links, so that links to the same article
+ * compare equal
+ */
+
+package link
+
+import (
+	"bread/config"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Indicate if a query parameter only tracks where a link was clicked
+func tracking(param string) bool {
+	param = strings.ToLower(param)
+	for _, p := range config.TrackingParams {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if prefix != "" && strings.HasPrefix(param, prefix) {
+				return true
+			}
+		} else if p == param {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Resolve a link that may be relative against the link of the feed it
+// came from. Links that cannot be resolved are returned unchanged.
+func Resolve(base, link string) string {
+	link = strings.TrimSpace(link)
+	if base == "" || link == "" {
+		return link
+	}
+
+	b, err := url.Parse(base)
+	if err != nil {
+		return link
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	return b.ResolveReference(u).String()
+}
+
+// Get the canonical form of a link. The scheme and host are lowercased,
+// default ports, fragments, tracking parameters and trailing slashes are
+// removed and the remaining parameters are sorted. Links that cannot be
+// parsed are returned unchanged.
+func Canonical(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return link
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && u.Port() == "80") || (u.Scheme == "https" && u.Port() == "443") {
+		u.Host = u.Hostname()
+	}
+
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.User = nil
+
+	if len(u.Path) > 1 {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = ""
+	}
+
+	// Remove tracking parameters, Encode sorts the rest by key
+	query := u.Query()
+	for param := range query {
+		if tracking(param) {
+			delete(query, param)
+		}
+	}
+	for _, values := range query {
+		sort.Strings(values)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// Get a key that is the same for links to the same article, whatever
+// their scheme or www prefix
+func Key(link string) string {
+	u, err := url.Parse(Canonical(link))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	u.Scheme = ""
+	u.Host = strings.TrimPrefix(u.Host, "www.")
+	if u.Path == "/" {
+		u.Path = ""
+	}
+
+	return strings.TrimPrefix(u.String(), "//")
+}
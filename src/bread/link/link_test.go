@@ -0,0 +1,66 @@
+package link
+
+import (
+	"bread/config"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		link      string
+		canonical string
+	}{
+		{"http://arstechnica.com/tech-policy/news/2012/03/isp.ars?clicked=related_right",
+			"http://arstechnica.com/tech-policy/news/2012/03/isp.ars"},
+		{"http://interviews.slashdot.org/story/12?utm_source=feedburner&utm_medium=feed",
+			"http://interviews.slashdot.org/story/12"},
+		{"HTTPS://Example.COM:443/a/b/?z=1&a=2#comments", "https://example.com/a/b?a=2&z=1"},
+		{"http://example.com/", "http://example.com/"},
+		{"not a link", "not a link"}}
+
+	for _, test := range tests {
+		if c := Canonical(test.link); c != test.canonical {
+			t.Error("Canonical(", test.link, ") = ", c, ", not ", test.canonical)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	a := Key("http://www.example.com/story?utm_source=rss")
+	b := Key("https://example.com/story/")
+	if a != b || a != "example.com/story" {
+		t.Error("Links to the same story have different keys:", a, b)
+	}
+
+	if Key("http://example.com/other") == a {
+		t.Error("Links to different stories have the same key")
+	}
+
+	if Key("") != "" {
+		t.Error("Empty link has a key")
+	}
+}
+
+func TestResolve(t *testing.T) {
+	base := "http://news.ycombinator.com/bigrss"
+	if l := Resolve(base, "item?id=1"); l != "http://news.ycombinator.com/item?id=1" {
+		t.Error("Relative link not resolved:", l)
+	}
+
+	if l := Resolve(base, "https://example.com/a"); l != "https://example.com/a" {
+		t.Error("Absolute link changed:", l)
+	}
+
+	if l := Resolve("", "item?id=1"); l != "item?id=1" {
+		t.Error("Link changed without a base:", l)
+	}
+}
+
+func TestTrackingParams(t *testing.T) {
+	defer func(p []string) { config.TrackingParams = p }(config.TrackingParams)
+
+	config.TrackingParams = []string{"source", "pk_*"}
+	if c := Canonical("http://a.com/?source=rss&pk_campaign=x&utm_source=y"); c != "http://a.com/?utm_source=y" {
+		t.Error("Configured tracking parameters not removed:", c)
+	}
+}
@@ -0,0 +1,172 @@
+package nbc
+
+// Fading of old training examples and the history of a classifier's
+// vocabulary
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// How old training examples fade
+const (
+	DecayNone     = iota // Examples never fade
+	DecayExamples        // Examples weigh half after HalfLife more examples
+	DecayTime            // Examples weigh half after HalfLife days
+)
+
+// Faded word counts below this are forgotten
+const minCount = 0.01
+
+// Fading is folded into the word counts once a class's scale falls below this
+const minScale = 1.0 / 1024
+
+// How often the top words of the classes are recorded
+var SnapshotInterval = 30 * 24 * time.Hour
+
+// The most snapshots that are kept
+const maxSnapshots = 24
+
+// The number of top words recorded for each class
+const snapshotWords = 10
+
+// The top words of each class in a period
+type Snapshot struct {
+	Time  time.Time  // When the period started
+	Words [][]string // The top words of each class at the end of the period
+}
+
+// Set how old examples fade. Examples that have already been seen keep
+// their current weight.
+func (c *Classifier) SetDecay(decay int, halfLife float64) error {
+	switch decay {
+	case DecayNone:
+		halfLife = 0
+	case DecayExamples, DecayTime:
+		if halfLife <= 0 {
+			return errors.New("Half life must be positive")
+		}
+	default:
+		return errors.New("Unknown decay")
+	}
+
+	c.Decay = decay
+	c.HalfLife = halfLife
+	return nil
+}
+
+// Get the factor that examples fade by when training at the given time
+func (c *Classifier) decayFactor(now time.Time) float64 {
+	switch c.Decay {
+	case DecayExamples:
+		return math.Exp2(-1 / c.HalfLife)
+	case DecayTime:
+		if c.Trained.IsZero() || !now.After(c.Trained) {
+			return 1
+		}
+		days := now.Sub(c.Trained).Hours() / 24
+		return math.Exp2(-days / c.HalfLife)
+	}
+
+	return 1
+}
+
+// Fade the examples seen before training at the given time. Only the scale
+// of each class changes, the word counts are rewritten when it gets small.
+func (c *Classifier) decay(now time.Time) {
+	f := c.decayFactor(now)
+	if f == 1 {
+		return
+	}
+
+	for i := range c.Classes {
+		class := &c.Classes[i]
+		class.Decayed *= f
+		class.Scale *= f
+		if class.Scale < minScale {
+			class.rescale()
+		}
+	}
+}
+
+// Fold the scale of a class into its word counts, forgetting the words that
+// have faded
+func (class *Class) rescale() {
+	for word, count := range class.Vocabulary {
+		if count*class.Scale < minCount {
+			delete(class.Vocabulary, word)
+		} else {
+			class.Vocabulary[word] = count * class.Scale
+		}
+	}
+
+	class.Scale = 1
+}
+
+// Get the words of a class with the highest counts
+func (c *Classifier) topWords(class int) []string {
+	words := c.WordsInClass(class)
+
+	ret := make([]string, 0, len(words))
+	for w := range words {
+		ret = append(ret, w)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if words[ret[i]] != words[ret[j]] {
+			return words[ret[i]] > words[ret[j]]
+		}
+		return ret[i] < ret[j]
+	})
+
+	if len(ret) > snapshotWords {
+		ret = ret[:snapshotWords]
+	}
+
+	return ret
+}
+
+// Get the top words of each class
+func (c *Classifier) allTopWords() [][]string {
+	ret := make([][]string, len(c.Classes))
+	for i := range c.Classes {
+		ret[i] = c.topWords(i)
+	}
+
+	return ret
+}
+
+// Start a new snapshot before training at the given time if the period of
+// the latest one is over, recording the top words at the end of that period
+func (c *Classifier) snapshot(now time.Time) {
+	if c.NoHistory {
+		return
+	}
+
+	n := len(c.History)
+	if n > 0 && now.Sub(c.History[n-1].Time) < SnapshotInterval {
+		return
+	}
+
+	if n > 0 {
+		c.History[n-1].Words = c.allTopWords()
+	}
+
+	c.History = append(c.History, Snapshot{Time: now})
+	if n+1 > maxSnapshots {
+		c.History = c.History[n+1-maxSnapshots:]
+	}
+}
+
+// Get the top words of each class over time, oldest first. The words of the
+// current period are those at present.
+func (c *Classifier) Snapshots() []Snapshot {
+	ret := append([]Snapshot(nil), c.History...)
+	if n := len(ret); n > 0 {
+		ret[n-1].Words = c.allTopWords()
+	}
+
+	return ret
+}
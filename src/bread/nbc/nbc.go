@@ -11,21 +11,47 @@ import (
 	"log"
 	"math"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 // A class that an item is classified into
 type Class struct {
-	Count      int            // The number of times this class has been assigned to
-	Prior      float64        // Log2 of the prior of this class
-	Vocabulary map[string]int // Word frequencies in the class
+	Count      int                // The number of times this class has been assigned to
+	Decayed    float64            // The count after old examples have faded
+	Prior      float64            // Log2 of the prior of this class
+	Vocabulary map[string]float64 // Word frequencies in the class before Scale is applied
+	Scale      float64            // The factor that fades the vocabulary
+}
+
+// How much a word counts towards a class
+type Contribution struct {
+	Word   string
+	Weight float64 // Log2 of how much more likely the word is in the class
 }
 
 // A classifier
 type Classifier struct {
-	Classes []Class // The classes making up the classification
-	Total   int     // The total number of times the classifier has been trained
-	Words   int     // The total number of words seen during training
+	Classes   []Class    // The classes making up the classification
+	Total     int        // The total number of times the classifier has been trained
+	Words     int        // The total number of words seen during training
+	Decay     int        // How old examples fade, see SetDecay
+	HalfLife  float64    // The examples or days after which old examples weigh half
+	Trained   time.Time  // When the classifier was last trained
+	History   []Snapshot // The top words of each class over time, oldest first
+	NoHistory bool       // Indicates that the top words are not recorded
+}
+
+// A classifier as it was serialised before word counts could fade
+type legacyClassifier struct {
+	Classes []struct {
+		Count      int
+		Prior      float64
+		Vocabulary map[string]int
+	}
+	Total int
+	Words int
 }
 
 // Punctuation that will be removed
@@ -46,7 +72,7 @@ func New(priors []float64) *Classifier {
 	ret.Classes = make([]Class, numclasses, numclasses)
 
 	for i := 0; i < numclasses; i++ {
-		ret.Classes[i] = Class{0, math.Log2(priors[i]), make(map[string]int)}
+		ret.Classes[i] = Class{Prior: math.Log2(priors[i]), Vocabulary: make(map[string]float64), Scale: 1}
 	}
 
 	return &ret
@@ -114,29 +140,56 @@ func removePunctuation(word string) (string, bool) {
 	return string(ret), true
 }
 
-// Update the given vocabulary with the given wordlist
-func updateVocabulary(vocab map[string]int, words []string) {
+// Get the frequency of a word in a class after fading
+func (class *Class) Frequency(word string) float64 {
+	return class.Vocabulary[word] * class.Scale
+}
+
+// Set the frequency of a word in a class after fading
+func (class *Class) SetFrequency(word string, count float64) {
+	class.Vocabulary[word] = count / class.Scale
+}
+
+// Update the vocabulary of the given class with the given wordlist
+func updateVocabulary(class *Class, words []string) {
 	for _, w := range words {
-		count := vocab[w]
-		count += 1
-		vocab[w] = count
+		class.Vocabulary[w] += 1 / class.Scale
 	}
 }
 
 // Train the classifier - the given wordlist belongs to the given class
 func (c *Classifier) Train(words []string, class int) {
+	c.TrainAt(words, class, time.Now())
+}
+
+// Train the classifier with an example seen at the given time
+func (c *Classifier) TrainAt(words []string, class int, now time.Time) {
+	// Record the top words if a period is over and fade the examples
+	// already seen
+	c.snapshot(now)
+	c.decay(now)
+	c.Trained = now
+
 	// Get the class the words belong to
 	tc := &c.Classes[class]
 
 	// Update the count and vocabularly
 	tc.Count += 1
-	updateVocabulary(tc.Vocabulary, words)
+	tc.Decayed += 1
+	updateVocabulary(tc, words)
 
 	// Update the total counts
 	c.Total += 1
 	c.Words += len(words)
 }
 
+// Forget a word that has been seen in the given class
+func (c *Classifier) Forget(word string, class int) {
+	tc := &c.Classes[class]
+	c.Words -= int(math.Round(tc.Frequency(word)))
+	delete(tc.Vocabulary, word)
+}
+
 // Train the classifier - the given text belongs to the given class
 func (c *Classifier) TrainText(text string, class int) {
 	c.Train(Wordlist(text), class)
@@ -169,17 +222,8 @@ func (c *Classifier) weight(class Class, words []string) float64 {
 
 	// Calculate the log likelihood log(P(words|class))
 	ll := prior
-	k := float64(c.Words)
 	for _, w := range words {
-		occurs := class.Vocabulary[w]
-		// Calculate the probability of the word appearing in this class
-		// but add smoothing to avoid overfitting
-		// P(w|class) = N(w,class) + 1
-		//              --------------
-		//              N(class) + k
-		// where:
-		//   k = number of words in the training set
-		pw := (float64(occurs) + 1) / (float64(class.Count) + k)
+		pw := c.wordProbability(class, w)
 		config.Debug("P(", w, "|class) = ", pw)
 		ll += math.Log2(pw)
 	}
@@ -188,19 +232,30 @@ func (c *Classifier) weight(class Class, words []string) float64 {
 	return ll
 }
 
+// Calculate the probability of a word appearing in a class but add
+// smoothing to avoid overfitting
+// P(w|class) = N(w,class) + 1
+//              --------------
+//              N(class) + k
+// where:
+//   k = number of words in the training set
+func (c *Classifier) wordProbability(class Class, word string) float64 {
+	return (class.Frequency(word) + 1) / (class.Decayed + float64(c.Words))
+}
+
 // Measure the ambiguity of a word
 // Taken from:
 //  Ambiguity Measure Feature-Selection Algorithm, 
 //  Saket S.R. Mengle and Nazli Goharian
 //  JOURNAL OF THE AMERICAN SOCIETY FOR INFORMATION SCIENCE AND TECHNOLOGY—May 2009
-func (c *Classifier) ambiguityMeasure(word string) (measure float64, total int) {
+func (c *Classifier) ambiguityMeasure(word string) (measure float64, total float64) {
 	
 	// Loop through the classes getting the max word frequency and total
-	max := 0
+	max := 0.0
 	total = 0
 	measure = 0
-	for _, class := range c.Classes {
-		freq := class.Vocabulary[word]
+	for i := range c.Classes {
+		freq := c.Classes[i].Frequency(word)
 		if freq > max {
 			max = freq
 		}
@@ -208,7 +263,7 @@ func (c *Classifier) ambiguityMeasure(word string) (measure float64, total int)
 	}
 
 	if total > 0 {
-		measure = float64(max)/float64(total)
+		measure = max/total
 	}
 
 	return measure, total
@@ -270,23 +325,90 @@ func (c *Classifier) Classify(words []string) int {
 	return h
 }
 
+// Calculate the probability that the given word list belongs to the given class
+func (c *Classifier) Probability(words []string, class int) float64 {
+
+	// Prefilter the words
+	filtered := c.Prefilter(words)
+
+	// Get the log2 weights of each class and the heaviest weight
+	weights := make([]float64, len(c.Classes))
+	hw := math.Inf(-1)
+	for i := range c.Classes {
+		weights[i] = c.weight(c.Classes[i], filtered)
+		hw = math.Max(hw, weights[i])
+	}
+
+	// P(class|words) = 2^w(class) / sum(2^w(i))
+	// The heaviest weight is subtracted to avoid underflow
+	sum := 0.0
+	for _, w := range weights {
+		sum += math.Exp2(w - hw)
+	}
+
+	return math.Exp2(weights[class]-hw) / sum
+}
+
+// Get how much each word of the given word list counts towards the given
+// class, the words that count the most either way first. Ambiguous words
+// are left out as they are when classifying.
+func (c *Classifier) Contributions(words []string, class int) []Contribution {
+	if c.Total == 0 {
+		return nil
+	}
+
+	// Sum the weight of words that appear more than once
+	weights := make(map[string]float64)
+	order := make([]string, 0, len(words))
+	for _, w := range c.Prefilter(words) {
+		if _, ok := weights[w]; !ok {
+			order = append(order, w)
+		}
+
+		// Compare the class with the most likely of the other classes
+		other := math.Inf(-1)
+		for i := range c.Classes {
+			if i != class && c.Classes[i].Count > 0 {
+				other = math.Max(other, math.Log2(c.wordProbability(c.Classes[i], w)))
+			}
+		}
+		if math.IsInf(other, -1) {
+			other = 0
+		}
+
+		weights[w] += math.Log2(c.wordProbability(c.Classes[class], w)) - other
+	}
+
+	ret := make([]Contribution, 0, len(order))
+	for _, w := range order {
+		ret = append(ret, Contribution{Word: w, Weight: weights[w]})
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		return math.Abs(ret[i].Weight) > math.Abs(ret[j].Weight)
+	})
+
+	return ret
+}
+
 // Classify the given text, returns the id of the class
 func (c *Classifier) ClassifyText(text string) int {
 	return c.Classify(Wordlist(text))
 }
 
-// Get the words in a class
+// Get the words in a class, faded counts are rounded
 func (c *Classifier) WordsInClass(class int) map[string]int {
 
 	cutoff := c.cutoff()
-	classes := len(c.Classes)
+	classes := float64(len(c.Classes))
 	ret := make(map[string]int)
 
 	// Get unambigious words in each class
-	for word, count := range c.Classes[class].Vocabulary {
+	for word := range c.Classes[class].Vocabulary {
+		count := c.Classes[class].Frequency(word)
 		am, total := c.ambiguityMeasure(word)
-		if am > cutoff && count > total/classes {
-			ret[word] = count
+		if am > cutoff && count > total/classes && count >= 0.5 {
+			ret[word] = int(math.Round(count))
 		}
 	}
 
@@ -313,10 +435,40 @@ func Deserialise(b []byte) (*Classifier, error) {
 	var classifier Classifier
 	err := dec.Decode(&classifier)
 
+	if err != nil {
+		return deserialiseLegacy(b)
+	}
+
+	// Classifiers serialised before fading was scaled hold faded counts
+	for i := range classifier.Classes {
+		if classifier.Classes[i].Scale == 0 {
+			classifier.Classes[i].Scale = 1
+		}
+	}
+
+	return &classifier, nil
+}
+
+// Create a classifier from a buffer serialised before word counts could fade
+func deserialiseLegacy(b []byte) (*Classifier, error) {
+	r := bytes.NewReader(b)
+	dec := gob.NewDecoder(r)
+	var legacy legacyClassifier
+	err := dec.Decode(&legacy)
+
 	if err != nil {
 		log.Println("Failed to decode classifier:", err)
 		return nil, err
 	}
 
-	return &classifier, nil
+	ret := &Classifier{Classes: make([]Class, len(legacy.Classes)), Total: legacy.Total, Words: legacy.Words}
+	for i, lc := range legacy.Classes {
+		ret.Classes[i] = Class{Count: lc.Count, Decayed: float64(lc.Count), Prior: lc.Prior,
+			Vocabulary: make(map[string]float64, len(lc.Vocabulary)), Scale: 1}
+		for word, count := range lc.Vocabulary {
+			ret.Classes[i].Vocabulary[word] = float64(count)
+		}
+	}
+
+	return ret, nil
 }
@@ -1,7 +1,11 @@
 package nbc
 
 import (
+	"bytes"
+	"encoding/gob"
+	"math"
 	"testing"
+	"time"
 )
 
 // Classes
@@ -55,6 +59,52 @@ func TestClassEasy(t *testing.T) {
 	}
 }
 
+func TestProbability(t *testing.T) {
+	c := New([]float64{0.5, 0.5})
+
+	// Train
+	for _, t := range training {
+		c.TrainText(t.text, t.class)
+	}
+
+	// The probabilities should agree with the classification
+	for _, tst := range testset {
+		words := Wordlist(tst.text)
+		pi := c.Probability(words, interesting)
+		pu := c.Probability(words, uninteresting)
+
+		if math.Abs(pi+pu-1) > 1e-9 {
+			t.Error(tst.text, "probabilities do not sum to 1:", pi, pu)
+		}
+
+		if pi != pu && (pi > pu) != (c.Classify(words) == interesting) {
+			t.Error(tst.text, "probabilities", pi, pu, "disagree with classification")
+		}
+	}
+}
+
+func TestContributions(t *testing.T) {
+	c := New([]float64{0.5, 0.5})
+
+	if c.Contributions(Wordlist("Scaling shoes"), interesting) != nil {
+		t.Error("Untrained classifier has contributions")
+	}
+
+	for _, t := range training {
+		c.TrainText(t.text, t.class)
+	}
+
+	cs := c.Contributions(Wordlist("Britney scaling unknown Britney"), interesting)
+	if len(cs) != 2 || cs[0].Word != "britney" || cs[1].Word != "scaling" {
+		t.Fatal("Wrong words contribute:", cs)
+	}
+
+	// Repeated words count twice
+	if cs[0].Weight >= 0 || cs[1].Weight <= 0 || -cs[0].Weight <= cs[1].Weight {
+		t.Error("Wrong contributions:", cs)
+	}
+}
+
 func TestSerialise(t *testing.T) {
 	c := New([]float64{0.5, 0.5})
 
@@ -92,3 +142,112 @@ func TestSerialise(t *testing.T) {
 		}
 	}
 }
+
+func TestForget(t *testing.T) {
+	c := New([]float64{0.5, 0.5})
+	c.TrainText(`Britney buys shoes.`, uninteresting)
+	c.TrainText(`Britney sings.`, uninteresting)
+
+	words := c.Words
+	c.Forget("britney", uninteresting)
+
+	if _, ok := c.Classes[uninteresting].Vocabulary["britney"]; ok {
+		t.Error("Forgotten word is still in the vocabulary")
+	}
+
+	if c.Words != words-2 {
+		t.Error("Word count not reduced:", c.Words, words)
+	}
+
+	// Forgetting a word that was never seen changes nothing
+	c.Forget("ruby", interesting)
+	if c.Words != words-2 {
+		t.Error("Word count changed by an unseen word:", c.Words)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	c := New([]float64{0.5, 0.5})
+	if c.SetDecay(DecayExamples, 0) == nil || c.SetDecay(DecayTime+1, 1) == nil {
+		t.Error("Invalid decay was set")
+	}
+
+	// Counts halve after each further example
+	c.SetDecay(DecayExamples, 1)
+	c.TrainText(`Scaling Ruby.`, interesting)
+	c.TrainText(`Britney buys shoes.`, uninteresting)
+	if ruby := c.Classes[interesting].Frequency("ruby"); math.Abs(ruby-0.5) > 1e-9 {
+		t.Error("Count did not fade by examples:", ruby)
+	}
+
+	if c.Classes[interesting].Count != 1 || math.Abs(c.Classes[interesting].Decayed-0.5) > 1e-9 {
+		t.Error("Class count did not fade:", c.Classes[interesting])
+	}
+
+	// Faded words are forgotten once the fading is folded into the counts
+	for i := 0; i < 12; i++ {
+		c.TrainText(`Britney buys shoes.`, uninteresting)
+	}
+	if _, ok := c.Classes[interesting].Vocabulary["ruby"]; ok {
+		t.Error("Faded word is still in the vocabulary")
+	}
+	if britney := c.Classes[uninteresting].Frequency("britney"); math.Abs(britney-2) > 1e-3 {
+		t.Error("Count did not fade across rescaling:", britney)
+	}
+
+	// Counts halve after each half life in days
+	c = New([]float64{0.5, 0.5})
+	c.SetDecay(DecayTime, 10)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.TrainAt(Wordlist(`Scaling Ruby.`), interesting, start)
+	c.TrainAt(Wordlist(`Scaling Ruby.`), interesting, start.Add(20*24*time.Hour))
+	if ruby := c.Classes[interesting].Frequency("ruby"); math.Abs(ruby-1.25) > 1e-9 {
+		t.Error("Count did not fade by time:", ruby)
+	}
+
+	// The top words are recorded for each period
+	c.TrainAt(Wordlist(`Britney buys shoes.`), uninteresting, start.Add(21*24*time.Hour))
+	c.TrainAt(Wordlist(`Pop stars are famous.`), uninteresting, start.Add(60*24*time.Hour))
+	if len(c.History) != 2 || !c.History[0].Time.Equal(start) {
+		t.Fatal("Snapshots not recorded for each period:", c.History)
+	}
+
+	// The words of the current period are those at present
+	history := c.Snapshots()
+	if history[0].Words[interesting][0] != "ruby" || len(history[1].Words[uninteresting]) != 2 {
+		t.Error("Snapshots have the wrong words:", history)
+	}
+
+	// Words that have faded are no longer top words
+	if len(history[1].Words[interesting]) != 0 {
+		t.Error("Faded word is still a top word:", history[1])
+	}
+}
+
+func TestDeserialiseLegacy(t *testing.T) {
+	var legacy legacyClassifier
+	legacy.Total = 1
+	legacy.Words = 2
+	legacy.Classes = make([]struct {
+		Count      int
+		Prior      float64
+		Vocabulary map[string]int
+	}, 2)
+	legacy.Classes[interesting].Count = 1
+	legacy.Classes[interesting].Vocabulary = map[string]int{"scaling": 1, "ruby": 1}
+
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Classifiers stored before counts could fade are converted
+	c, err := Deserialise(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Total != 1 || c.Classes[interesting].Decayed != 1 || c.Classes[interesting].Frequency("ruby") != 1 {
+		t.Error("Legacy classifier not converted:", c)
+	}
+}
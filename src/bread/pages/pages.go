@@ -4,17 +4,27 @@ package pages
 import (
 	"bread/session"
 	"bread/config"
+	"encoding/json"
 	"html/template"
 	"net/http"
 	"log"
 	"path"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// The largest profile that can be imported
+const maxProfileSize = 32 << 20
+
 // Package scope variables
 var indexTemplate *template.Template
 var profileTemplate *template.Template
 var readTemplate *template.Template
+var searchTemplate *template.Template
+var storyTemplate *template.Template
+var savedTemplate *template.Template
 
 // Get static content
 func Static(w http.ResponseWriter, req *http.Request) {
@@ -97,6 +107,132 @@ func Comments(w http.ResponseWriter, req *http.Request) {
 	http.Redirect(w, req, "/", http.StatusTemporaryRedirect)
 }
 
+// Show the detail of a story
+func Story(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	var storyid int64
+	cnt, _ := fmt.Sscan(req.Form.Get("id"), &storyid)
+	if cnt != 1 {
+		http.NotFound(w, req)
+		return
+	}
+
+	detail, err := session.Detail(w, req, storyid)
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	// Display the story page
+	err = storyTemplate.Execute(w, detail)
+	if err != nil {
+		log.Println("Executing story.tmpl: ", err)
+	}
+}
+
+// Upvote or downvote a story
+func Vote(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	var storyid int64
+	cnt, _ := fmt.Sscan(req.Form.Get("id"), &storyid)
+	if cnt != 1 {
+		http.Error(w, "No story", http.StatusBadRequest)
+		return
+	}
+
+	var ok bool
+	switch req.Form.Get("vote") {
+	case "up":
+		ok = session.Vote(w, req, storyid, session.Interesting)
+	case "down":
+		ok = session.Vote(w, req, storyid, session.Uninteresting)
+	default:
+		http.Error(w, "Unknown vote", http.StatusBadRequest)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	http.Redirect(w, req, fmt.Sprint("/story?id=", storyid), http.StatusSeeOther)
+}
+
+// Save a story to read later, optionally training it as interesting
+func Save(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	var storyid int64
+	cnt, _ := fmt.Sscan(req.Form.Get("id"), &storyid)
+	if cnt == 1 && !session.Save(w, req, storyid, req.Form.Get("train") != "") {
+		return
+	}
+
+	backTo(w, req, storyid)
+}
+
+// Remove a story from the reading list
+func Unsave(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	var storyid int64
+	cnt, _ := fmt.Sscan(req.Form.Get("id"), &storyid)
+	if cnt == 1 && !session.Unsave(w, req, storyid) {
+		return
+	}
+
+	backTo(w, req, storyid)
+}
+
+// Return to the page a story was saved or removed from
+func backTo(w http.ResponseWriter, req *http.Request, storyid int64) {
+	switch req.Form.Get("from") {
+	case "story":
+		http.Redirect(w, req, fmt.Sprint("/story?id=", storyid), http.StatusSeeOther)
+	case "saved":
+		http.Redirect(w, req, "/saved", http.StatusSeeOther)
+	default:
+		http.Redirect(w, req, "/", http.StatusSeeOther)
+	}
+}
+
+// Stories that have been saved to read later
+func Saved(w http.ResponseWriter, req *http.Request) {
+
+	page, _ := PageAndQuery(req)
+
+	// Request the saved stories
+	stories, ok := session.SavedStories(w, req, page)
+	if !ok {
+		return
+	}
+
+	// Display the reading list
+	err := savedTemplate.Execute(w, stories)
+	if err != nil {
+		log.Println("Executing saved.tmpl: ", err)
+	}
+}
+
 // Display the homepage
 func Home(w http.ResponseWriter, req *http.Request) {
 
@@ -107,7 +243,10 @@ func Home(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Request the stories 
-	stories := session.FilteredStories(w, req, 0)
+	stories, ok := session.FilteredStories(w, req, 0)
+	if !ok {
+		return
+	}
 
 	// Display the index page
 	index(w, stories)
@@ -127,10 +266,15 @@ func Next(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Mark the stories up to here as being browsed
-	session.MarkBrowsed(w, req, storyid)
+	if !session.MarkBrowsed(w, req, storyid) {
+		return
+	}
 
 	// Request more stories
-	stories := session.FilteredStories(w, req, storyid)
+	stories, ok := session.FilteredStories(w, req, storyid)
+	if !ok {
+		return
+	}
 
 	// Display the index page
 	index(w, stories)
@@ -151,7 +295,10 @@ func Previous(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// Request the previous stories
-	stories := session.UnfilteredStories(w, req, storyid)
+	stories, ok := session.UnfilteredStories(w, req, storyid)
+	if !ok {
+		return
+	}
 
 	// Display the index page
 	index(w, stories)
@@ -160,8 +307,13 @@ func Previous(w http.ResponseWriter, req *http.Request) {
 // Stories that have been read
 func HaveRead(w http.ResponseWriter, req *http.Request) {
 
+	page, query := PageAndQuery(req)
+
 	// Request the read stories
-	stories := session.HaveReadStories(w, req)
+	stories, ok := session.HaveReadStories(w, req, page, query)
+	if !ok {
+		return
+	}
 
 	// Display the have read page
 	err := readTemplate.Execute(w, stories)
@@ -170,6 +322,39 @@ func HaveRead(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Search all stories
+func Search(w http.ResponseWriter, req *http.Request) {
+
+	page, query := PageAndQuery(req)
+
+	// Request the search results
+	results, ok := session.Search(w, req, query, page)
+	if !ok {
+		return
+	}
+
+	// Display the search page
+	err := searchTemplate.Execute(w, results)
+	if err != nil {
+		log.Println("Executing search.tmpl: ", err)
+	}
+}
+
+// Get the page number and search from a request
+func PageAndQuery(req *http.Request) (int, string) {
+
+	req.ParseForm()
+
+	qpage := req.Form.Get("page")
+	var page int
+	cnt, _ := fmt.Sscan(qpage, &page)
+	if cnt != 1 || page < 0 {
+		page = 0
+	}
+
+	return page, strings.TrimSpace(req.Form.Get("q"))
+}
+
 // Display an index of stories
 func index(w http.ResponseWriter, i *session.StoryIndex) {
 
@@ -183,7 +368,10 @@ func index(w http.ResponseWriter, i *session.StoryIndex) {
 // Show the users profile
 func Profile(w http.ResponseWriter, req *http.Request) {
 	// Request the user's profile
-	profile := session.Profile(w, req)
+	profile, ok := session.Profile(w, req)
+	if !ok {
+		return
+	}
 
 	// Display the profile page
 	err := profileTemplate.Execute(w, profile)
@@ -192,6 +380,146 @@ func Profile(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Reset the classifier of the users profile
+func ResetProfile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !session.ResetProfile(w, req) {
+		return
+	}
+
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// Download the users full profile as JSON
+func ExportProfile(w http.ResponseWriter, req *http.Request) {
+	profile, ok := session.ExportProfile(w, req)
+	if !ok {
+		return
+	}
+
+	name := "bread-profile-" + time.Now().Format("20060102") + ".json"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+
+	err := json.NewEncoder(w).Encode(profile)
+	if err != nil {
+		log.Println("Encoding profile: ", err)
+	}
+}
+
+// Upload a profile exported from this or another instance
+func ImportProfile(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxProfileSize)
+	file, _, err := req.FormFile("profile")
+	if err != nil {
+		http.Error(w, "No profile uploaded", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	err = session.ImportProfile(w, req, file)
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// Pin, block or delete a word of the users profile
+func EditWord(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	class := session.Interesting
+	if req.Form.Get("class") == "uninteresting" {
+		class = session.Uninteresting
+	}
+
+	err := session.EditWord(w, req, req.Form.Get("word"), req.Form.Get("action"), class)
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// Set how the old examples of the users profile fade
+func EditDecay(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	var halfLife float64
+	fmt.Sscan(req.Form.Get("halflife"), &halfLife)
+
+	err := session.SetDecay(w, req, req.Form.Get("decay"), halfLife)
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
+// Add or delete a filter rule of the users profile
+func EditRule(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.ParseForm()
+
+	var err error
+	if _, ok := req.Form["delete"]; ok {
+		index, aerr := strconv.Atoi(req.Form.Get("delete"))
+		if aerr != nil {
+			http.Error(w, "Bad rule", http.StatusBadRequest)
+			return
+		}
+		_, err = session.DeleteRule(w, req, index)
+	} else {
+		_, err = session.AddRule(w, req, session.Rule{
+			Field:   req.Form.Get("field"),
+			Match:   req.Form.Get("match"),
+			Pattern: req.Form.Get("pattern"),
+			Action:  req.Form.Get("action")})
+	}
+
+	if err == session.ErrNoSession {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, req, "/profile", http.StatusSeeOther)
+}
+
 // Parse required templates
 func Start() {
 
@@ -210,5 +538,20 @@ func Start() {
 	if err != nil {
 		log.Fatal("Parsing profile.tmpl: ", err)
 	}
+
+	searchTemplate, err = template.ParseFiles("templates/search.tmpl")
+	if err != nil {
+		log.Fatal("Parsing search.tmpl: ", err)
+	}
+
+	storyTemplate, err = template.ParseFiles("templates/story.tmpl")
+	if err != nil {
+		log.Fatal("Parsing story.tmpl: ", err)
+	}
+
+	savedTemplate, err = template.ParseFiles("templates/saved.tmpl")
+	if err != nil {
+		log.Fatal("Parsing saved.tmpl: ", err)
+	}
 }
 
@@ -0,0 +1,61 @@
+package recommend
+
+// Offline evaluation of recommendations against held out reads
+
+// The results of an evaluation
+type Evaluation struct {
+	Users          int     // Users with a read held out
+	Hits           int     // Held out reads that were recommended
+	HitRate        float64 // The fraction of held out reads that were recommended
+	PopularHits    int     // Held out reads among the most popular stories
+	PopularHitRate float64 // The hit rate of recommending the most popular stories
+}
+
+// Evaluate recommendations of n stories. The last read of each user with
+// more than one read is held out, a model is built from the other reads
+// and a hit is counted when the held out read is recommended. Recommending
+// the most popular stories is evaluated in the same way for comparison.
+func Evaluate(reads map[string][]int64, n int) *Evaluation {
+	training := make(map[string][]int64, len(reads))
+	held := make(map[string]int64)
+
+	for user, read := range reads {
+		if len(read) < 2 {
+			training[user] = read
+			continue
+		}
+
+		training[user] = read[:len(read)-1]
+		held[user] = read[len(read)-1]
+	}
+
+	m := Build(training)
+	ret := &Evaluation{Users: len(held)}
+
+	for user, id := range held {
+		if contains(m.Recommend(training[user], n, nil), id) {
+			ret.Hits++
+		}
+		if contains(m.Popular(training[user], n), id) {
+			ret.PopularHits++
+		}
+	}
+
+	if ret.Users > 0 {
+		ret.HitRate = float64(ret.Hits) / float64(ret.Users)
+		ret.PopularHitRate = float64(ret.PopularHits) / float64(ret.Users)
+	}
+
+	return ret
+}
+
+// Indicate if a story is in a list of stories
+func contains(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
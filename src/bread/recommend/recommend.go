@@ -0,0 +1,239 @@
+/*
+ * Recommends stories read by users who read the same stories
+ */
+
+package recommend
+
+import (
+	"bread/db"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the recommendations are rebuilt from the read history
+const period = time.Hour
+
+// The most recent reads of each user that are used
+const maxUserReads = 200
+
+// The most similar stories kept for each story
+const maxNeighbours = 20
+
+// A story and how similar it is to another
+type neighbour struct {
+	id         int64
+	similarity float64
+}
+
+// Item-item similarities built from the reads of all users
+type Model struct {
+	similar map[int64][]neighbour // The most similar stories to each story
+	popular []int64               // Stories ordered by their number of readers
+}
+
+// A scored recommendation
+type scored struct {
+	id    int64
+	score float64
+}
+
+// The model used by the package level functions
+var model = Build(nil)
+var mutex sync.RWMutex
+
+// The first story that can be recommended, earlier reads are not used
+var start int64
+
+// Get the most recent reads of a user without duplicates
+func recentReads(read []int64) []int64 {
+	if len(read) > maxUserReads {
+		read = read[len(read)-maxUserReads:]
+	}
+
+	seen := make(map[int64]bool, len(read))
+	ret := make([]int64, 0, len(read))
+	for _, id := range read {
+		if !seen[id] {
+			seen[id] = true
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
+
+// Build a model from the stories each user has read. The similarity of
+// two stories is the cosine of their sets of readers.
+func Build(reads map[string][]int64) *Model {
+	readers := make(map[int64]int)
+	together := make(map[int64]map[int64]int)
+
+	// Count the readers of each story and of each pair of stories
+	for _, r := range reads {
+		read := recentReads(r)
+		for i, a := range read {
+			readers[a]++
+			for _, b := range read[i+1:] {
+				if together[a] == nil {
+					together[a] = make(map[int64]int)
+				}
+				if together[b] == nil {
+					together[b] = make(map[int64]int)
+				}
+				together[a][b]++
+				together[b][a]++
+			}
+		}
+	}
+
+	ret := &Model{similar: make(map[int64][]neighbour, len(together)), popular: make([]int64, 0, len(readers))}
+
+	for a, counts := range together {
+		n := make([]neighbour, 0, len(counts))
+		for b, count := range counts {
+			sim := float64(count) / math.Sqrt(float64(readers[a]*readers[b]))
+			n = append(n, neighbour{id: b, similarity: sim})
+		}
+
+		sort.Slice(n, func(i, j int) bool {
+			if n[i].similarity != n[j].similarity {
+				return n[i].similarity > n[j].similarity
+			}
+			return n[i].id > n[j].id
+		})
+
+		if len(n) > maxNeighbours {
+			n = n[:maxNeighbours]
+		}
+		ret.similar[a] = n
+	}
+
+	for id := range readers {
+		ret.popular = append(ret.popular, id)
+	}
+
+	sort.Slice(ret.popular, func(i, j int) bool {
+		a, b := ret.popular[i], ret.popular[j]
+		if readers[a] != readers[b] {
+			return readers[a] > readers[b]
+		}
+		return a > b
+	})
+
+	return ret
+}
+
+// Get up to n stories similar to those a user has read, most similar
+// first. Stories the user has read and stories that are not wanted are
+// skipped, want may be nil.
+func (m *Model) Recommend(read []int64, n int, want func(int64) bool) []int64 {
+	read = recentReads(read)
+
+	haveRead := make(map[int64]bool, len(read))
+	for _, id := range read {
+		haveRead[id] = true
+	}
+
+	// Add up the similarity of each story to the stories read
+	scores := make(map[int64]float64)
+	for _, id := range read {
+		for _, nb := range m.similar[id] {
+			if haveRead[nb.id] {
+				continue
+			}
+			scores[nb.id] += nb.similarity
+		}
+	}
+
+	candidates := make([]scored, 0, len(scores))
+	for id, score := range scores {
+		if want == nil || want(id) {
+			candidates = append(candidates, scored{id, score})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].id > candidates[j].id
+	})
+
+	ret := make([]int64, 0, n)
+	for i := 0; i < len(candidates) && i < n; i++ {
+		ret = append(ret, candidates[i].id)
+	}
+
+	return ret
+}
+
+// Get up to n of the most read stories that a user has not read
+func (m *Model) Popular(read []int64, n int) []int64 {
+	haveRead := make(map[int64]bool, len(read))
+	for _, id := range read {
+		haveRead[id] = true
+	}
+
+	ret := make([]int64, 0, n)
+	for _, id := range m.popular {
+		if len(ret) == n {
+			break
+		}
+		if !haveRead[id] {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
+
+// Get up to n stories similar to those a user has read using the latest
+// model
+func Recommend(read []int64, n int, want func(int64) bool) []int64 {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return model.Recommend(read, n, want)
+}
+
+// Set the first story that can be recommended
+func SetStart(id int64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	start = id
+}
+
+// Rebuild the model from the reads in the db of the stories that can be
+// recommended
+func rebuild() {
+	mutex.RLock()
+	minid := start
+	mutex.RUnlock()
+
+	reads := db.GetReads(minid)
+	m := Build(reads)
+
+	mutex.Lock()
+	model = m
+	mutex.Unlock()
+
+	log.Println("Built recommendations from the reads of", len(reads), "sessions")
+}
+
+// The maintenance function that is run within a go routine
+func maintenance() {
+	rebuild()
+
+	for _ = range time.Tick(period) {
+		rebuild()
+	}
+}
+
+// Start the go routine that rebuilds the recommendations
+func Start() {
+	go maintenance()
+}
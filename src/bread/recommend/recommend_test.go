@@ -0,0 +1,57 @@
+package recommend
+
+import (
+	"testing"
+)
+
+// The stories read by some users, in the order they were read
+var reads = map[string][]int64{
+	"a": {1, 2, 3},
+	"b": {1, 2, 4},
+	"c": {5, 6},
+	"d": {1, 2}}
+
+func TestRecommend(t *testing.T) {
+	m := Build(reads)
+
+	// Stories read with both read stories rank first, newest first on ties
+	recs := m.Recommend([]int64{1, 2}, 10, nil)
+	if len(recs) != 2 || recs[0] != 4 || recs[1] != 3 {
+		t.Error("Wrong recommendations:", recs)
+	}
+
+	recs = m.Recommend([]int64{1, 2}, 10, func(id int64) bool { return id != 4 })
+	if len(recs) != 1 || recs[0] != 3 {
+		t.Error("Unwanted story recommended:", recs)
+	}
+
+	// Stories nobody read with the read stories are not recommended
+	recs = m.Recommend([]int64{5}, 10, nil)
+	if len(recs) != 1 || recs[0] != 6 {
+		t.Error("Wrong recommendations:", recs)
+	}
+
+	if recs := m.Recommend(nil, 10, nil); len(recs) != 0 {
+		t.Error("Recommendations without reads:", recs)
+	}
+
+	if popular := m.Popular([]int64{1}, 2); len(popular) != 2 || popular[0] != 2 {
+		t.Error("Wrong popular stories:", popular)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	e := Evaluate(reads, 1)
+
+	if e.Users != 4 || e.Hits != 1 || e.HitRate != 0.25 {
+		t.Error("Wrong evaluation:", e)
+	}
+
+	if e.PopularHits != 1 {
+		t.Error("Wrong popular evaluation:", e)
+	}
+
+	if e := Evaluate(nil, 1); e.Users != 0 || e.HitRate != 0 {
+		t.Error("Evaluation without reads:", e)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * Removes old stories and sessions from the database
+ */
+
+package retention
+
+import (
+	"bread/config"
+	"bread/db"
+	"bread/session"
+	"log"
+	"time"
+)
+
+// How often the retention policy is applied
+const period = 24 * time.Hour
+
+// The length of a month for the retention policy
+const month = 30 * 24 * time.Hour
+
+// Apply the retention policy in the configuration
+func apply() {
+	now := time.Now()
+
+	// Get the times before which rows are removed
+	var storyTime, sessionTime int64
+	if config.StoryDays > 0 {
+		storyTime = now.Add(-time.Duration(config.StoryDays) * 24 * time.Hour).Unix()
+	}
+	if config.SessionMonths > 0 {
+		sessionTime = now.Add(-time.Duration(config.SessionMonths) * month).Unix()
+	}
+
+	// The stories a session can show are looked up by their position from
+	// the first one, so they are never removed
+	expired := db.Expire(storyTime, sessionTime, session.MaxStories, config.RetentionDry)
+
+	if config.RetentionDry {
+		log.Println("Retention dry run would remove", expired.Stories,
+			"stories and", expired.Sessions, "sessions")
+	} else {
+		log.Println("Retention removed", expired.Stories,
+			"stories and", expired.Sessions, "sessions")
+	}
+}
+
+// The maintenance function that is run within a go routine
+func maintenance() {
+	apply()
+
+	for _ = range time.Tick(period) {
+		apply()
+	}
+}
+
+// Start the maintenance go routine if there is a retention policy
+func Start() {
+	if config.StoryDays > 0 || config.SessionMonths > 0 {
+		go maintenance()
+	}
+}
@@ -0,0 +1,167 @@
+package rss
+
+// Sanitises the HTML of feed summaries for display and extracts their text
+// for classification
+
+import (
+	"encoding/xml"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Elements whose contents are removed
+var unsafeContent = regexp.MustCompile(`(?is)<script\b.*?</script\s*>|<style\b.*?</style\s*>|<!--.*?-->`)
+
+// A < that does not start a tag
+var strayLt = regexp.MustCompile(`<([^a-zA-Z/!?]|$)`)
+
+// Elements kept by the sanitiser
+var allowed = map[string]bool{
+	"a": true, "b": true, "blockquote": true, "br": true, "code": true,
+	"em": true, "i": true, "li": true, "ol": true, "p": true, "pre": true,
+	"strong": true, "ul": true}
+
+// Elements that have no end tag
+var void = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true,
+	"hr": true, "img": true, "input": true, "link": true, "meta": true,
+	"param": true, "source": true, "track": true, "wbr": true}
+
+// Elements that do not separate words
+var inline = map[string]bool{
+	"a": true, "abbr": true, "b": true, "code": true, "em": true, "font": true,
+	"i": true, "s": true, "small": true, "span": true, "strong": true,
+	"sub": true, "sup": true, "u": true}
+
+// Call a function with each token of a fragment of HTML, entities are
+// decoded in text. Tokens after an error in the HTML are ignored.
+func tokens(fragment string, fn func(xml.Token)) {
+	fragment = unsafeContent.ReplaceAllString(fragment, "")
+	fragment = strayLt.ReplaceAllString(fragment, "&lt;$1")
+
+	d := xml.NewDecoder(strings.NewReader(fragment))
+	d.Strict = false
+	d.Entity = xml.HTMLEntity
+
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return
+		}
+
+		fn(tok)
+	}
+}
+
+// Get the link of an anchor if it is safe to follow
+func safeLink(attrs []xml.Attr) (string, bool) {
+	for _, a := range attrs {
+		if strings.ToLower(a.Name.Local) != "href" {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSpace(a.Value))
+		if err != nil {
+			return "", false
+		}
+
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "mailto":
+			return u.String(), true
+		}
+	}
+
+	return "", false
+}
+
+// An element opened in a fragment of HTML
+type element struct {
+	name string
+	kept bool // Indicates that the sanitiser kept the element
+}
+
+// Sanitise a fragment of HTML so that it is safe to display. Only simple
+// formatting and links are kept and every element is closed.
+func Sanitise(fragment string) string {
+	var b strings.Builder
+	var open []element
+
+	tokens(fragment, func(tok xml.Token) {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if name == "br" {
+				b.WriteString("<br>")
+				return
+			} else if void[name] {
+				return
+			} else if !allowed[name] {
+				open = append(open, element{name: name})
+				return
+			}
+
+			if name == "a" {
+				if href, ok := safeLink(t.Attr); ok {
+					b.WriteString(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener">`)
+				} else {
+					b.WriteString("<a>")
+				}
+			} else {
+				b.WriteString("<" + name + ">")
+			}
+			open = append(open, element{name: name, kept: true})
+
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+
+			// Close the element and any elements opened within it
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i].name == name {
+					for j := len(open) - 1; j >= i; j-- {
+						if open[j].kept {
+							b.WriteString("</" + open[j].name + ">")
+						}
+					}
+					open = open[:i]
+					break
+				}
+			}
+
+		case xml.CharData:
+			b.WriteString(html.EscapeString(string(t)))
+		}
+	})
+
+	for i := len(open) - 1; i >= 0; i-- {
+		if open[i].kept {
+			b.WriteString("</" + open[i].name + ">")
+		}
+	}
+
+	return strings.TrimSpace(b.String())
+}
+
+// Get the text of a fragment of HTML with entities decoded and whitespace
+// collapsed
+func PlainText(fragment string) string {
+	var b strings.Builder
+
+	tokens(fragment, func(tok xml.Token) {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if !inline[strings.ToLower(t.Name.Local)] {
+				b.WriteString(" ")
+			}
+		case xml.EndElement:
+			if !inline[strings.ToLower(t.Name.Local)] {
+				b.WriteString(" ")
+			}
+		case xml.CharData:
+			b.Write(t)
+		}
+	})
+
+	return strings.Join(strings.Fields(b.String()), " ")
+}
@@ -12,11 +12,13 @@ import (
 )
 
 type Story struct {
-	Id       string
-	Title    string `xml:"title"`
-	Link     string `xml:"link"`
-	Comments string `xml:"comments"`
-	Summary  string
+	Id        string
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	Canonical string `xml:"-"` // The canonical form of Link
+	Comments  string `xml:"comments"`
+	Summary   string `xml:"description"` // Sanitised HTML
+	Text      string `xml:"-"`           // The text of Summary
 }
 
 type Channel struct {
@@ -52,9 +54,13 @@ func Decode(filename string) ([]*Story, error) {
 	log.Println("Feed title, ", feed.Ch.Title)
 	log.Println("Feed description, ", feed.Ch.Description)
 
-	// Loop through the items and extract an id
+	// Loop through the items and extract an id, sanitise the summary and
+	// get its text
 	for i, _ := range feed.Ch.Items {
-		feed.Ch.Items[i].Id = extractId(feed.Ch.Items[i].Comments)
+		item := feed.Ch.Items[i]
+		item.Id = extractId(item.Comments)
+		item.Text = PlainText(item.Summary)
+		item.Summary = Sanitise(item.Summary)
 	}
 
 	return feed.Ch.Items, nil
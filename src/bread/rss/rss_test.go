@@ -20,3 +20,37 @@ func TestDecode(t *testing.T) {
 
 	t.Error(items[0])
 }
+
+func TestSanitise(t *testing.T) {
+	tests := []struct {
+		html      string
+		sanitised string
+	}{
+		{`<a href="http://news.ycombinator.com/item?id=1">Comments</a>`,
+			`<a href="http://news.ycombinator.com/item?id=1" rel="nofollow noopener">Comments</a>`},
+		{`<p onclick="steal()">Hello<script>steal()</script> <b>world`, `<p>Hello <b>world</b></p>`},
+		{`<a href="javascript:steal()">link</a><img src=x onerror=steal()>`, `<a>link</a>`},
+		{`<div><i>a < b</div> &amp; "c"`, `<i>a &lt; b</i> &amp; &#34;c&#34;`}}
+
+	for _, test := range tests {
+		if s := Sanitise(test.html); s != test.sanitised {
+			t.Error("Sanitise(", test.html, ") = ", s, ", not ", test.sanitised)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		html string
+		text string
+	}{
+		{`<a href="http://news.ycombinator.com/item?id=1">Comments</a>`, "Comments"},
+		{`<p>One&#x2014;two</p><p>three&nbsp;&amp; <em>fo</em>ur</p>`, "One—two three & four"},
+		{`Hello<br/>world<style>p { color: red }</style>`, "Hello world"}}
+
+	for _, test := range tests {
+		if s := PlainText(test.html); s != test.text {
+			t.Error("PlainText(", test.html, ") = ", s, ", not ", test.text)
+		}
+	}
+}
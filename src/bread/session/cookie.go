@@ -2,10 +2,11 @@ package session
 
 import (
 	"bread/config"
-	"bread/nbc"
+	"cache"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"log"
 	"math"
 	"math/big"
@@ -14,6 +15,13 @@ import (
 
 var maxSessionId *big.Int
 
+// Returned when a request has no session, nothing more should be written
+// to the response
+var ErrNoSession = errors.New("No session")
+
+// Returned when a story is not in the fifo
+var ErrNoStory = errors.New("No such story")
+
 // Generate a unique id as a base64 encoded string
 func generateId() string {
 
@@ -35,9 +43,14 @@ func newSession() *Session {
 	s := new(Session)
 	s.id = generateId()
 	s.isNew = true
-	s.classifier = nbc.New([]float64{InterestingPrior, UninterestingPrior})
+	s.classifier = newClassifier()
 	s.haveRead = make(map[int64]bool)
 	s.haveIgnored = make(map[int64]bool)
+	s.upvoted = make(map[int64]bool)
+	s.saved = make(map[int64]bool)
+	s.pinned = make(map[string]bool)
+	s.blocked = make(map[string]bool)
+	s.rules = make([]*Rule, 0)
 	s.haveBrowsed = 0
 	return s
 }
@@ -52,18 +65,36 @@ func sessionCookie(w http.ResponseWriter, req *http.Request) (string, bool) {
 	return cookie.Value, true
 }
 
+// How long clients are asked to wait when their session cannot be read
+const retryAfter = "10"
+
 // Get the session from the cookie in the request
-// Creates a new session and cookie if none can be found
+// Creates a new session and cookie if none can be found. If the session
+// exists but cannot be read the response is marked unavailable and the
+// cookie is kept, so that the session is not lost.
 func getSession(w http.ResponseWriter, req *http.Request) (*Session, bool) {
 
 	cookie, err := req.Cookie("id")
 	if err == nil {
-		s, ok := sessionSync(cookie.Value)
-		if ok {
-			return s, ok
+		s, err := sessionSync(req.Context(), cookie.Value)
+		if err == nil {
+			return s, true
+		}
+
+		// Don't replace the session of a client that has gone away
+		if req.Context().Err() != nil {
+			return nil, false
+		}
+
+		// Only replace sessions that do not exist
+		if !errors.Is(err, cache.ErrNotFound) {
+			log.Println("Cannot read session ", cookie.Value, ": ", err)
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return nil, false
 		}
 
-		log.Println("Invalid session cookie presented: ", cookie.Value)
+		log.Println("Invalid session cookie presented: ", cookie.Value, ": ", err)
 	}
 
 	// Create a session
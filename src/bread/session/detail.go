@@ -0,0 +1,230 @@
+package session
+
+// The detail of a story, why it is or is not interesting to a user and the
+// stories like it
+
+import (
+	"bread/nbc"
+	"bread/recommend"
+	"bread/story"
+	"net/http"
+	"sort"
+)
+
+// The number of words shown for and against a story
+const contributingWords = 8
+
+// The number of similar stories shown with a story
+const similarPerStory = 5
+
+// Stories must share this many words to be similar
+const minSharedWords = 2
+
+// The detail of a story for a user
+type StoryDetail struct {
+	Story       *story.Story
+	Read        bool
+	Upvoted     bool
+	Saved       bool
+	Ignored     bool               // Indicates the story is not shown again
+	Interesting bool               // Indicates the story is shown as interesting
+	Interest    float64            // The percentage chance the user finds the story interesting
+	Reason      string             // Why the story is or is not interesting
+	For         []nbc.Contribution // The words that make the story interesting
+	Against     []nbc.Contribution // The words that make the story uninteresting
+	Alternates  []*story.Story     // Other links to the same story
+	Similar     []*story.Story     // Stories read by the same users or with the same words
+}
+
+// Explain why a story is or is not interesting to a user
+func (s *Session) reason(st *story.Story) string {
+	if action, ok := s.ruleAction(st); ok {
+		switch action {
+		case RuleHide:
+			return "A rule hides this story"
+		case RuleFilter:
+			return "A rule filters this story"
+		default:
+			return "A rule boosts this story"
+		}
+	}
+
+	if class, ok := s.fixedClass(st.Wordlist); ok {
+		if class == Interesting {
+			return "The story contains a pinned word"
+		}
+		return "The story contains a blocked word"
+	}
+
+	if s.maturity() < 1 {
+		return "Your profile has few examples, so what other readers read counts too"
+	}
+
+	return "The classifier weighed the words of the story"
+}
+
+// Split the contributions of a story's words into the strongest for and
+// against it being interesting
+func (s *Session) contributions(st *story.Story) (ret, against []nbc.Contribution) {
+	ret = make([]nbc.Contribution, 0, contributingWords)
+	against = make([]nbc.Contribution, 0, contributingWords)
+
+	for _, c := range s.classifier.Contributions(st.Wordlist, Interesting) {
+		if c.Weight > 0 && len(ret) < contributingWords {
+			ret = append(ret, c)
+		} else if c.Weight < 0 && len(against) < contributingWords {
+			c.Weight = -c.Weight
+			against = append(against, c)
+		}
+	}
+
+	return ret, against
+}
+
+// Get up to n stories in the fifo that are like a story, those read by the
+// same users first and then those sharing the most words. The stories mutex
+// must be held.
+func similar(session *Session, st *story.Story, n int) []*story.Story {
+	skip := map[int64]bool{st.Id: true}
+	for _, id := range dups.others(st.Id) {
+		skip[id] = true
+	}
+
+	want := func(id int64) bool {
+		if skip[id] || session.haveIgnored[id] {
+			return false
+		}
+		s, ok := stories.get(id)
+		return ok && !session.hidden(s)
+	}
+
+	ret := make([]*story.Story, 0, n)
+	for _, id := range recommend.Recommend([]int64{st.Id}, n, want) {
+		s, _ := stories.get(id)
+		ret = append(ret, s)
+		skip[id] = true
+	}
+
+	if len(ret) == n {
+		return ret
+	}
+
+	// Count the words each story shares with the story
+	words := make(map[string]bool, len(st.Wordlist))
+	for _, w := range st.Wordlist {
+		words[w] = true
+	}
+
+	type candidate struct {
+		story  *story.Story
+		shared int
+	}
+	candidates := make([]candidate, 0)
+
+	for id := stories.end; id >= stories.start; id-- {
+		if !want(id) || dups.isDuplicate(id) {
+			continue
+		}
+
+		s, _ := stories.get(id)
+		shared := make(map[string]bool)
+		for _, w := range s.Wordlist {
+			if words[w] {
+				shared[w] = true
+			}
+		}
+
+		if len(shared) >= minSharedWords {
+			candidates = append(candidates, candidate{s, len(shared)})
+		}
+	}
+
+	// Newer stories win ties
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].shared > candidates[j].shared
+	})
+
+	for i := 0; i < len(candidates) && len(ret) < n; i++ {
+		ret = append(ret, candidates[i].story)
+	}
+
+	return ret
+}
+
+// Get the detail of a story for a user
+func Detail(w http.ResponseWriter, req *http.Request, storyid int64) (*StoryDetail, error) {
+	st, ok := GetStory(storyid)
+	if !ok {
+		return nil, ErrNoStory
+	}
+
+	ret := &StoryDetail{Story: st}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	defer session.release()
+
+	ret.Read = session.haveRead[storyid]
+	ret.Upvoted = session.upvoted[storyid]
+	ret.Saved = session.saved[storyid]
+	ret.Ignored = session.haveIgnored[storyid]
+	ret.Interesting = session.isInteresting(st)
+	ret.Interest = 100 * session.storyInterest(st)
+	ret.Reason = session.reason(st)
+	ret.For, ret.Against = session.contributions(st)
+
+	// We are about to access stories
+	stories.mutex.RLock()
+	defer stories.mutex.RUnlock()
+
+	ret.Alternates = make([]*story.Story, 0)
+	for _, id := range dups.others(st.Id) {
+		if s, ok := stories.get(id); ok {
+			ret.Alternates = append(ret.Alternates, s)
+		}
+	}
+
+	ret.Similar = similar(session, st, similarPerStory)
+
+	return ret, nil
+}
+
+// Train a user's classifier with a story they voted for. Upvoted stories
+// are interesting, downvoted ones uninteresting and no longer shown.
+// Returns false if there is no session.
+func Vote(w http.ResponseWriter, req *http.Request, storyid int64, class int) bool {
+	session, ok := getSession(w, req)
+	if !ok {
+		return false
+	}
+
+	defer session.release()
+
+	vote(session, storyid, class)
+	return true
+}
+
+// Train a user's classifier with a vote, each story is only counted once
+// for each way it is voted
+func vote(session *Session, storyid int64, class int) {
+	if class == Interesting {
+		if session.haveRead[storyid] || session.upvoted[storyid] {
+			return
+		}
+		session.upvoted[storyid] = true
+		delete(session.haveIgnored, storyid)
+	} else {
+		if session.haveIgnored[storyid] {
+			return
+		}
+		session.haveIgnored[storyid] = true
+		delete(session.upvoted, storyid)
+	}
+
+	session.classifyStory(storyid, class)
+	session.haveClassified = 0
+	session.modified = true
+}
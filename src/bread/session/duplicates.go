@@ -0,0 +1,90 @@
+package session
+
+// Stories that duplicate an earlier story in the fifo, the index shows one
+// entry per cluster with links to the alternates
+
+import (
+	"bread/cluster"
+	"bread/story"
+)
+
+// The clusters of the stories in the fifo, guarded by the stories mutex
+type duplicates struct {
+	index      *cluster.Index
+	primary    map[int64]int64   // The first story of the cluster of each duplicate
+	alternates map[int64][]int64 // The duplicates of each first story
+}
+
+var dups = newDuplicates()
+
+// Create an empty set of clusters
+func newDuplicates() *duplicates {
+	return &duplicates{
+		index:      cluster.New(MaxStories),
+		primary:    make(map[int64]int64),
+		alternates: make(map[int64][]int64)}
+}
+
+// Cluster a story added to the fifo
+func (d *duplicates) add(s *story.Story) {
+	p, dup := d.index.Add(s.Id, s.Rss.Link, s.Rss.Title)
+	if dup {
+		d.primary[s.Id] = p
+		d.alternates[p] = append(d.alternates[p], s.Id)
+	}
+}
+
+// Forget the clusters of stories that have left the fifo
+func (d *duplicates) expire(start int64) {
+	for id := range d.primary {
+		if id < start {
+			delete(d.primary, id)
+		}
+	}
+
+	for id := range d.alternates {
+		if id < start {
+			delete(d.alternates, id)
+		}
+	}
+}
+
+// Indicate if a story duplicates a story that is still in the fifo
+func (d *duplicates) isDuplicate(id int64) bool {
+	p, ok := d.primary[id]
+	return ok && p >= stories.start
+}
+
+// Get the ids of the other stories in the cluster of a story
+func (d *duplicates) others(id int64) []int64 {
+	p, ok := d.primary[id]
+	if !ok {
+		p = id
+	}
+
+	ret := make([]int64, 0)
+	if p != id {
+		ret = append(ret, p)
+	}
+	for _, alt := range d.alternates[p] {
+		if alt != id {
+			ret = append(ret, alt)
+		}
+	}
+
+	return ret
+}
+
+// Get the alternates of the given stories
+func (d *duplicates) alternatesOf(ss []*story.Story) map[int64][]*story.Story {
+	ret := make(map[int64][]*story.Story)
+	for _, s := range ss {
+		for _, id := range d.alternates[s.Id] {
+			if alt, ok := stories.get(id); ok {
+				ret[s.Id] = append(ret[s.Id], alt)
+			}
+		}
+	}
+
+	return ret
+}
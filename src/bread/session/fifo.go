@@ -63,3 +63,15 @@ func (f *fifo) get(story int64) (*story.Story, bool) {
 	idx := (f.head + int(story-f.start)) % len(f.index)
 	return f.index[idx], true
 }
+
+// Replace the given story in the fifo, returns false if it has left the fifo
+func (f *fifo) set(s *story.Story) bool {
+
+	if len(f.index) == 0 || s.Id < f.start || s.Id > f.end {
+		return false
+	}
+
+	idx := (f.head + int(s.Id-f.start)) % len(f.index)
+	f.index[idx] = s
+	return true
+}
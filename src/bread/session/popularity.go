@@ -0,0 +1,164 @@
+package session
+
+// What all users read, used to recommend stories to users whose classifier
+// has seen few examples
+
+import (
+	"bread/config"
+	"bread/db"
+	"bread/nbc"
+	"bread/story"
+	"log"
+	"sync"
+	"time"
+)
+
+// Users whose classifier has seen this many examples only use their own
+// classifier
+const matureExamples = 50
+
+// Stories read by this many users are interesting to new users
+const popularReaders = 2
+
+// Examples of the global classifier weigh half after this many more
+const globalHalfLife = 1000
+
+// How often the global classifier is trained with the queued examples
+const crowdTrainPeriod = time.Minute
+
+// The most examples queued for the global classifier, more are dropped
+const maxCrowdExamples = 10000
+
+// An example for the global classifier
+type example struct {
+	words []string
+	class int
+}
+
+// The reading of all users
+type crowd struct {
+	mutex      sync.RWMutex
+	readers    map[int64]int   // The number of users that read each story in the fifo
+	classifier *nbc.Classifier // Trained by all users, nil unless configured
+	examples   []example       // Examples queued for the classifier
+}
+
+var everyone = &crowd{readers: make(map[int64]int)}
+
+// Count the readers of the stories in the fifo and read the global
+// classifier, or create it if it has never been written
+func initCrowd() {
+	everyone.mutex.Lock()
+	defer everyone.mutex.Unlock()
+
+	everyone.readers = db.GetReaders(stories.start)
+
+	if !config.GlobalClassifier {
+		return
+	}
+
+	if b, ok := db.GetGlobalClassifier(); ok {
+		classifier, err := nbc.Deserialise(b)
+		if err == nil {
+			everyone.classifier = classifier
+			return
+		}
+		log.Println("Cannot read the global classifier, starting a new one: ", err)
+	}
+
+	everyone.classifier = newClassifier()
+	everyone.classifier.SetDecay(nbc.DecayExamples, globalHalfLife)
+	everyone.classifier.NoHistory = true
+}
+
+// Count a new reader of a story
+func (c *crowd) read(storyid int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readers[storyid]++
+}
+
+// Queue an example for the global classifier if there is one
+func (c *crowd) train(words []string, class int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.classifier != nil && len(c.examples) < maxCrowdExamples {
+		c.examples = append(c.examples, example{words, class})
+	}
+}
+
+// Train the global classifier with the queued examples and write it to the
+// db so that it survives a restart (within the background go routine)
+func (c *crowd) trainQueued() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.examples) == 0 {
+		return
+	}
+
+	for _, e := range c.examples {
+		c.classifier.Train(e.words, e.class)
+	}
+
+	c.examples = c.examples[0:0]
+
+	b, err := c.classifier.Serialise()
+	if err != nil {
+		return
+	}
+	db.WriteGlobalClassifier(b)
+}
+
+// Forget the readers of stories that have left the fifo
+func (c *crowd) expire(start int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for id := range c.readers {
+		if id < start {
+			delete(c.readers, id)
+		}
+	}
+}
+
+// The probability that a user the server knows nothing about finds a
+// story interesting
+func (c *crowd) interest(st *story.Story) float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	r := float64(c.readers[st.Id])
+	ret := r / (r + popularReaders)
+
+	if c.classifier != nil && c.classifier.Total > 0 {
+		ret = (ret + c.classifier.Probability(st.Wordlist, Interesting)) / 2
+	}
+
+	return ret
+}
+
+// How much a user's own classifier is trusted, from 0 for a new user to 1
+// once it has seen enough examples
+func (s *Session) maturity() float64 {
+	if s.classifier.Total >= matureExamples {
+		return 1
+	}
+
+	return float64(s.classifier.Total) / matureExamples
+}
+
+// The probability that a user finds a story interesting. What everyone
+// reads is blended out as the user's classifier matures.
+func (s *Session) storyInterest(st *story.Story) float64 {
+	p := s.interest(st.Wordlist)
+
+	m := s.maturity()
+	if _, fixed := s.fixedClass(st.Wordlist); fixed || m >= 1 {
+		return p
+	}
+
+	return m*p + (1-m)*everyone.interest(st)
+}
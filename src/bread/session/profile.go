@@ -0,0 +1,367 @@
+package session
+
+// Reset, export and import of a user's profile
+
+import (
+	"bread/db"
+	"bread/nbc"
+	"bread/story"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+)
+
+// The version of the exported profile format. Version 2 added fading of
+// old examples, so word counts may be fractional.
+const ProfileVersion = 2
+
+// The names of the ways old examples can fade
+var decayNames = map[string]int{
+	"none":     nbc.DecayNone,
+	"examples": nbc.DecayExamples,
+	"time":     nbc.DecayTime}
+
+// The number of read stories got from the db at a time
+const exportPage = 100
+
+// The words a class has been trained with
+type ExportedClass struct {
+	Count      int                `json:"count"`
+	Decayed    float64            `json:"decayed"`
+	Vocabulary map[string]float64 `json:"vocabulary"`
+}
+
+// The top words of a user's classes in a period
+type VocabularySnapshot struct {
+	Time          time.Time `json:"time"`
+	Interesting   []string  `json:"interesting"`
+	Uninteresting []string  `json:"uninteresting"`
+}
+
+// A classifier in the exported profile format
+type ExportedClassifier struct {
+	Total         int                  `json:"total"`
+	Words         int                  `json:"words"`
+	Decay         string               `json:"decay"`
+	HalfLife      float64              `json:"halflife"`
+	Trained       time.Time            `json:"trained"`
+	Interesting   ExportedClass        `json:"interesting"`
+	Uninteresting ExportedClass        `json:"uninteresting"`
+	History       []VocabularySnapshot `json:"history"`
+}
+
+// A story in the exported profile format. Stories are identified by the id
+// given by their provider, ids assigned by the db differ between instances.
+type ExportedStory struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Link  string `json:"link"`
+}
+
+// A user's full profile
+type ExportedProfile struct {
+	Version    int                `json:"version"`
+	Classifier ExportedClassifier `json:"classifier"`
+	Read       []ExportedStory    `json:"read"`
+	Ignored    []ExportedStory    `json:"ignored"`
+	Pinned     []string           `json:"pinned"`
+	Blocked    []string           `json:"blocked"`
+	Rules      []Rule             `json:"rules"`
+}
+
+// Create a new classifier for a user
+func newClassifier() *nbc.Classifier {
+	return nbc.New([]float64{InterestingPrior, UninterestingPrior})
+}
+
+// Copy a class into the exported format, the copy can be used after the
+// session is released
+func exportClass(c *nbc.Class) ExportedClass {
+	ret := ExportedClass{Count: c.Count, Decayed: c.Decayed, Vocabulary: make(map[string]float64, len(c.Vocabulary))}
+	for word := range c.Vocabulary {
+		ret.Vocabulary[word] = c.Frequency(word)
+	}
+
+	return ret
+}
+
+// Copy an exported class into a class of a classifier. Profiles exported
+// before examples could fade have no decayed count.
+func importClass(c *nbc.Class, ec *ExportedClass) {
+	c.Count = ec.Count
+	c.Decayed = ec.Decayed
+	if c.Decayed == 0 {
+		c.Decayed = float64(ec.Count)
+	}
+	for word, count := range ec.Vocabulary {
+		c.SetFrequency(word, count)
+	}
+}
+
+// Get the name of the way a classifier's examples fade
+func decayName(decay int) string {
+	for name, d := range decayNames {
+		if d == decay {
+			return name
+		}
+	}
+
+	return "none"
+}
+
+// Copy the history of a classifier's vocabulary
+func exportHistory(c *nbc.Classifier) []VocabularySnapshot {
+	history := c.Snapshots()
+	ret := make([]VocabularySnapshot, 0, len(history))
+	for _, s := range history {
+		vs := VocabularySnapshot{Time: s.Time, Interesting: make([]string, 0), Uninteresting: make([]string, 0)}
+		if len(s.Words) > Uninteresting {
+			vs.Interesting = append(vs.Interesting, s.Words[Interesting]...)
+			vs.Uninteresting = append(vs.Uninteresting, s.Words[Uninteresting]...)
+		}
+		ret = append(ret, vs)
+	}
+
+	return ret
+}
+
+// Convert a story to the exported format
+func exportStory(s *story.Story) ExportedStory {
+	return ExportedStory{Id: s.Rss.Id, Title: s.Rss.Title, Link: s.Rss.Link}
+}
+
+// Reset the classifier of a user so that training starts over, returns
+// false if there is no session
+func ResetProfile(w http.ResponseWriter, req *http.Request) bool {
+	session, ok := getSession(w, req)
+	if !ok {
+		return false
+	}
+
+	defer session.release()
+
+	session.classifier = newClassifier()
+	session.haveClassified = 0
+	session.modified = true
+	return true
+}
+
+// Set how the old examples of a user fade. The half life is in examples
+// or days.
+func SetDecay(w http.ResponseWriter, req *http.Request, decay string, halfLife float64) error {
+	d, ok := decayNames[decay]
+	if !ok {
+		return errors.New("Unknown decay")
+	}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return ErrNoSession
+	}
+
+	defer session.release()
+
+	err := session.classifier.SetDecay(d, halfLife)
+	if err != nil {
+		return err
+	}
+
+	session.modified = true
+	return nil
+}
+
+// Get the full profile of a user
+func ExportProfile(w http.ResponseWriter, req *http.Request) (*ExportedProfile, bool) {
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	defer session.release()
+
+	c := session.classifier
+	ret := &ExportedProfile{
+		Version: ProfileVersion,
+		Classifier: ExportedClassifier{
+			Total:         c.Total,
+			Words:         c.Words,
+			Decay:         decayName(c.Decay),
+			HalfLife:      c.HalfLife,
+			Trained:       c.Trained,
+			Interesting:   exportClass(&c.Classes[Interesting]),
+			Uninteresting: exportClass(&c.Classes[Uninteresting]),
+			History:       exportHistory(c)},
+		Read:    make([]ExportedStory, 0),
+		Ignored: make([]ExportedStory, 0),
+		Pinned:  sortedWords(session.pinned),
+		Blocked: sortedWords(session.blocked),
+		Rules:   make([]Rule, 0, len(session.rules))}
+
+	for _, r := range session.rules {
+		ret.Rules = append(ret.Rules, *r)
+	}
+
+	// Get the whole read history, newest first
+	for offset := 0; ; offset += exportPage {
+		read := db.ReadHistory(session.id, offset, exportPage)
+		for _, s := range read {
+			ret.Read = append(ret.Read, exportStory(s))
+		}
+
+		if len(read) < exportPage {
+			break
+		}
+	}
+
+	// Ignored stories are only kept while they are in the fifo
+	stories.mutex.RLock()
+	defer stories.mutex.RUnlock()
+
+	for id := range session.haveIgnored {
+		if s, ok := stories.get(id); ok {
+			ret.Ignored = append(ret.Ignored, exportStory(s))
+		}
+	}
+
+	return ret, true
+}
+
+// Check an exported profile can be imported
+func (p *ExportedProfile) validate() error {
+	if p.Version == 0 {
+		return errors.New("Not a bread profile")
+	} else if p.Version > ProfileVersion {
+		return fmt.Errorf("Profile version %d is newer than this server supports", p.Version)
+	}
+
+	c := &p.Classifier
+	if c.Total != c.Interesting.Count+c.Uninteresting.Count || c.Words < 0 {
+		return errors.New("Profile has an inconsistent classifier")
+	}
+
+	if err := c.Interesting.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Uninteresting.validate(); err != nil {
+		return err
+	}
+
+	if math.IsNaN(c.HalfLife) || math.IsInf(c.HalfLife, 0) {
+		return errors.New("Profile has an invalid half life")
+	}
+
+	// Profiles exported before examples could fade have no decay
+	if c.Decay == "" {
+		c.Decay = "none"
+	}
+
+	d, ok := decayNames[c.Decay]
+	if !ok {
+		return errors.New("Profile has an unknown decay")
+	}
+
+	return newClassifier().SetDecay(d, c.HalfLife)
+}
+
+// Indicate if a count is a number that can be classified with
+func validCount(count float64) bool {
+	return count >= 0 && !math.IsInf(count, 1)
+}
+
+// Check that the counts of an exported class are valid, invalid counts
+// would make every classification fail
+func (ec *ExportedClass) validate() error {
+	if ec.Count < 0 || !validCount(ec.Decayed) {
+		return errors.New("Profile has an invalid class count")
+	}
+
+	for _, count := range ec.Vocabulary {
+		if !validCount(count) {
+			return errors.New("Profile has an invalid word count")
+		}
+	}
+
+	return nil
+}
+
+// Convert an exported classifier into a classifier
+func (c *ExportedClassifier) classifier() *nbc.Classifier {
+	ret := newClassifier()
+	ret.Total = c.Total
+	ret.Words = c.Words
+	ret.SetDecay(decayNames[c.Decay], c.HalfLife)
+	ret.Trained = c.Trained
+	importClass(&ret.Classes[Interesting], &c.Interesting)
+	importClass(&ret.Classes[Uninteresting], &c.Uninteresting)
+
+	for _, vs := range c.History {
+		ret.History = append(ret.History, nbc.Snapshot{Time: vs.Time,
+			Words: [][]string{vs.Interesting, vs.Uninteresting}})
+	}
+
+	return ret
+}
+
+// Replace the classifier, words and rules of a user with those in an
+// exported profile and add the profile's read and ignored stories. Stories this instance has not
+// seen are skipped.
+func ImportProfile(w http.ResponseWriter, req *http.Request, r io.Reader) error {
+	var p ExportedProfile
+	err := json.NewDecoder(r).Decode(&p)
+	if err != nil {
+		return fmt.Errorf("Cannot read profile: %v", err)
+	}
+
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return ErrNoSession
+	}
+
+	defer session.release()
+
+	session.classifier = p.Classifier.classifier()
+	session.pinned = wordSet(p.Pinned)
+	session.blocked = wordSet(p.Blocked)
+	session.rules = compileRules(p.Rules)
+	session.haveClassified = 0
+	session.modified = true
+
+	stories.mutex.RLock()
+	defer stories.mutex.RUnlock()
+
+	for _, es := range p.Read {
+		id, ok := db.SeenStory(es.Id)
+		if !ok || len(db.GetRead(session.id, id, id)) > 0 {
+			continue
+		}
+
+		db.MarkRead(session.id, id)
+		if _, ok := stories.get(id); ok {
+			session.haveRead[id] = true
+			delete(session.haveIgnored, id)
+		}
+	}
+
+	for _, es := range p.Ignored {
+		id, ok := db.SeenStory(es.Id)
+		if !ok || session.haveRead[id] {
+			continue
+		}
+
+		if _, ok := stories.get(id); ok {
+			session.haveIgnored[id] = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package session
+
+// Stories read by users who read the same stories as a user
+
+import (
+	"bread/recommend"
+	"bread/story"
+	"net/http"
+	"sort"
+)
+
+// The number of recommended stories shown on the index page
+const recommendedPerPage = 5
+
+// Get up to n stories read by users who read the same stories as a user.
+// Stories the user has ignored, hidden or saved, and those to ignore, are
+// skipped. The stories mutex must be held.
+func recommended(session *Session, n int, ignore map[int64]bool) []*story.Story {
+
+	// Newer stories have higher ids
+	read := make([]int64, 0, len(session.haveRead))
+	for id := range session.haveRead {
+		read = append(read, id)
+	}
+	sort.Slice(read, func(i, j int) bool { return read[i] < read[j] })
+
+	want := func(id int64) bool {
+		if session.haveIgnored[id] || session.saved[id] || ignore[id] {
+			return false
+		}
+		s, ok := stories.get(id)
+		return ok && !session.hidden(s)
+	}
+
+	ret := make([]*story.Story, 0, n)
+	for _, id := range recommend.Recommend(read, n, want) {
+		s, _ := stories.get(id)
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+// Get up to n stories read by users who read the same stories as a user
+func Recommended(w http.ResponseWriter, req *http.Request, n int) ([]*story.Story, bool) {
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	defer session.release()
+
+	// We are about to access stories
+	stories.mutex.RLock()
+	defer stories.mutex.RUnlock()
+
+	return recommended(session, n, nil), true
+}
@@ -0,0 +1,267 @@
+package session
+
+// Filter rules a user has written, these are applied before the classifier
+
+import (
+	"bread/story"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The parts of a story a rule can match
+const (
+	RuleTitle   = "title"
+	RuleSummary = "summary"
+	RuleHost    = "host" // The host of the story's link
+)
+
+// How a rule matches
+const (
+	RuleKeyword = "keyword" // The part contains the pattern, ignoring case
+	RuleRegexp  = "regexp"  // The part matches the regular expression
+)
+
+// What a rule does to the stories it matches
+const (
+	RuleHide   = "hide"   // The story is never shown
+	RuleBoost  = "boost"  // The story is always interesting
+	RuleFilter = "filter" // The story is never interesting
+)
+
+// The most rules a user can have
+const maxRules = 100
+
+// The longest pattern a rule can have
+const maxPattern = 200
+
+// A filter rule
+type Rule struct {
+	Field   string `json:"field"`
+	Match   string `json:"match"`
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+
+	re *regexp.Regexp // The compiled pattern of regexp rules
+}
+
+// Check a rule is valid and prepare it for matching
+func (r *Rule) compile() error {
+	if r.Field != RuleTitle && r.Field != RuleSummary && r.Field != RuleHost {
+		return errors.New("Unknown field")
+	}
+
+	if r.Action != RuleHide && r.Action != RuleBoost && r.Action != RuleFilter {
+		return errors.New("Unknown action")
+	}
+
+	if r.Pattern == "" || len(r.Pattern) > maxPattern {
+		return errors.New("Pattern must be between 1 and 200 characters")
+	}
+
+	switch r.Match {
+	case RuleKeyword:
+		r.re = nil
+	case RuleRegexp:
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.re = re
+	default:
+		return errors.New("Unknown match")
+	}
+
+	return nil
+}
+
+// Get the host of a link
+func linkHost(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+
+	return u.Hostname()
+}
+
+// Indicate if a rule matches a story
+func (r *Rule) matches(s *story.Story) bool {
+	var text string
+	switch r.Field {
+	case RuleTitle:
+		text = s.Rss.Title
+	case RuleSummary:
+		text = s.Rss.Text
+	case RuleHost:
+		text = linkHost(s.Rss.Link)
+	}
+
+	if r.re != nil {
+		return r.re.MatchString(text)
+	}
+
+	return strings.Contains(strings.ToLower(text), strings.ToLower(r.Pattern))
+}
+
+// Get the action of the rules that match a story. Hiding takes precedence
+// over filtering, which takes precedence over boosting.
+func (s *Session) ruleAction(st *story.Story) (string, bool) {
+	action := ""
+	for _, r := range s.rules {
+		if !r.matches(st) {
+			continue
+		}
+
+		switch {
+		case r.Action == RuleHide:
+			return RuleHide, true
+		case r.Action == RuleFilter:
+			action = RuleFilter
+		case action == "":
+			action = RuleBoost
+		}
+	}
+
+	return action, action != ""
+}
+
+// Indicate if a story is interesting to a user, rules are applied before
+// the classifier. Users with little training also get popular stories.
+func (s *Session) isInteresting(st *story.Story) bool {
+	if action, ok := s.ruleAction(st); ok {
+		return action == RuleBoost
+	}
+
+	if s.maturity() >= 1 {
+		return s.classify(st.Wordlist) == Interesting
+	}
+
+	return s.storyInterest(st) >= 0.5
+}
+
+// Indicate if a story is hidden by a rule
+func (s *Session) hidden(st *story.Story) bool {
+	action, _ := s.ruleAction(st)
+	return action == RuleHide
+}
+
+// Copy the filter rules of a session
+func (s *Session) ruleList() []Rule {
+	ret := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		ret = append(ret, *r)
+	}
+
+	return ret
+}
+
+// Get the filter rules of a user
+func Rules(w http.ResponseWriter, req *http.Request) ([]Rule, error) {
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	defer session.release()
+
+	return session.ruleList(), nil
+}
+
+// Add a filter rule for a user, returns the user's rules
+func AddRule(w http.ResponseWriter, req *http.Request, r Rule) ([]Rule, error) {
+	err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	defer session.release()
+
+	if len(session.rules) >= maxRules {
+		return nil, errors.New("Too many rules")
+	}
+
+	session.rules = append(session.rules, &r)
+	session.haveClassified = 0
+	session.modified = true
+	return session.ruleList(), nil
+}
+
+// Delete the filter rule with the given index
+func DeleteRule(w http.ResponseWriter, req *http.Request, index int) ([]Rule, error) {
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, ErrNoSession
+	}
+
+	defer session.release()
+
+	if index < 0 || index >= len(session.rules) {
+		return nil, errors.New("No such rule")
+	}
+
+	session.rules = append(session.rules[:index], session.rules[index+1:]...)
+	session.haveClassified = 0
+	session.modified = true
+	return session.ruleList(), nil
+}
+
+// Compile rules that have been stored or imported, invalid rules are dropped
+func compileRules(rules []Rule) []*Rule {
+	ret := make([]*Rule, 0, len(rules))
+	for i := 0; i < len(rules) && len(ret) < maxRules; i++ {
+		r := rules[i]
+		err := r.compile()
+		if err != nil {
+			log.Println("Dropping invalid rule ", r.Pattern, ": ", err)
+			continue
+		}
+		ret = append(ret, &r)
+	}
+
+	return ret
+}
+
+// Serialise filter rules
+func serialiseRules(rules []*Rule) ([]byte, error) {
+	s := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		s = append(s, *r)
+	}
+
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(s)
+	if err != nil {
+		log.Println("Failed to encode rules:", err)
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Deserialise filter rules, sessions that have never had a rule have none
+// stored
+func deserialiseRules(b []byte) ([]*Rule, error) {
+	var s []Rule
+	if len(b) > 0 {
+		dec := gob.NewDecoder(bytes.NewReader(b))
+		err := dec.Decode(&s)
+		if err != nil {
+			log.Println("Failed to decode rules:", err)
+			return nil, err
+		}
+	}
+
+	return compileRules(s), nil
+}
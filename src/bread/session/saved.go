@@ -0,0 +1,104 @@
+package session
+
+// Stories saved to read later, they are neither read nor ignored until the
+// user reads them from the reading list
+
+import (
+	"bread/db"
+	"net/http"
+)
+
+// The number of saved stories on a page of the reading list
+const savedPerPage = 20
+
+// Save a story to read later, optionally training it as interesting.
+// Returns false if there is no session.
+func Save(w http.ResponseWriter, req *http.Request, storyid int64, train bool) bool {
+	session, ok := getSession(w, req)
+	if !ok {
+		return false
+	}
+
+	defer session.release()
+
+	save(session, storyid, train)
+	return true
+}
+
+// Save a story to read later
+func save(session *Session, storyid int64, train bool) {
+	if train {
+		vote(session, storyid, Interesting)
+	}
+
+	if session.saved[storyid] || session.haveRead[storyid] {
+		return
+	}
+
+	session.saved[storyid] = true
+	db.SaveStory(session.id, storyid)
+}
+
+// Remove a story from the reading list, returns false if there is no
+// session
+func Unsave(w http.ResponseWriter, req *http.Request, storyid int64) bool {
+	session, ok := getSession(w, req)
+	if !ok {
+		return false
+	}
+
+	defer session.release()
+
+	unsave(session, storyid)
+	return true
+}
+
+// Remove a story from the reading list
+func unsave(session *Session, storyid int64) {
+	delete(session.saved, storyid)
+	db.UnsaveStory(session.id, storyid)
+}
+
+// Get a page of the stories a user has saved, most recently saved first
+func SavedStories(w http.ResponseWriter, req *http.Request, page int) (*ReadIndex, bool) {
+
+	ret := &ReadIndex{}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	defer session.release()
+
+	// Get one more story than needed to find out if there is a next page
+	ret.Stories = db.SavedStories(session.id, page*savedPerPage, savedPerPage+1)
+
+	if len(ret.Stories) > savedPerPage {
+		ret.Stories = ret.Stories[:savedPerPage]
+		ret.Next = page + 1
+		ret.HaveNext = true
+	}
+
+	if page > 0 {
+		ret.Previous = page - 1
+		ret.HavePrevious = true
+	}
+
+	return ret, true
+}
+
+// Get the saved stories in the fifo from the DB
+func getSavedMap(sessionid string) map[int64]bool {
+
+	// We are about to access the stories fifo
+	stories.mutex.RLock()
+	defer stories.mutex.RUnlock()
+
+	ret := make(map[int64]bool)
+	for _, s := range db.GetSaved(sessionid, stories.start, stories.end) {
+		ret[s] = true
+	}
+
+	return ret
+}
@@ -0,0 +1,130 @@
+package session
+
+// Searches all stories and ranks them for a user
+
+import (
+	"bread/db"
+	"bread/story"
+	"net/http"
+	"sort"
+)
+
+// The number of matches that are ranked for a search
+const searchCandidates = 200
+
+// The number of search results on a page
+const searchPerPage = 20
+
+// How much the classifier contributes to the rank of a search result
+const searchInterestWeight = 0.3
+
+// A story found by a search
+type SearchResult struct {
+	Story     *story.Story
+	Relevance float64 // Text relevance scaled so the best match is 1
+	Interest  float64 // The probability the user finds the story interesting
+	Score     float64 // The blend of relevance and interest used for ranking
+}
+
+// A page of search results
+type SearchIndex struct {
+	Query        string
+	Previous     int
+	Next         int
+	HavePrevious bool
+	HaveNext     bool
+	Results      []*SearchResult
+}
+
+// Sort search results by decreasing score
+type searchResults []*SearchResult
+
+func (r searchResults) Len() int {
+	return len(r)
+}
+
+func (r searchResults) Less(i, j int) bool {
+	return r[i].Score > r[j].Score
+}
+
+func (r searchResults) Swap(i, j int) {
+	r[i], r[j] = r[j], r[i]
+}
+
+// Search all stories and rank the matches using the user's classifier
+func Search(w http.ResponseWriter, req *http.Request, query string, page int) (*SearchIndex, bool) {
+
+	ret := &SearchIndex{Query: query, Results: make([]*SearchResult, 0)}
+	if query == "" {
+		return ret, true
+	}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return nil, false
+	}
+
+	defer session.release()
+
+	matches := db.SearchStories(query, searchCandidates)
+	results := rankMatches(session, matches)
+
+	// Get the requested page
+	start := page * searchPerPage
+	if start < len(results) {
+		end := start + searchPerPage
+		if end < len(results) {
+			ret.Next = page + 1
+			ret.HaveNext = true
+		} else {
+			end = len(results)
+		}
+		ret.Results = results[start:end]
+	}
+
+	if page > 0 {
+		ret.Previous = page - 1
+		ret.HavePrevious = true
+	}
+
+	return ret, true
+}
+
+// Blend the text relevance of matches with the interest of the user
+func rankMatches(session *Session, matches []*db.Match) []*SearchResult {
+
+	// Scale the relevance by the best match
+	best := 0.0
+	for _, m := range matches {
+		if m.Relevance > best {
+			best = m.Relevance
+		}
+	}
+
+	ret := make([]*SearchResult, 0, len(matches))
+	for _, m := range matches {
+		action, _ := session.ruleAction(m.Story)
+		if action == RuleHide {
+			continue
+		}
+
+		r := &SearchResult{Story: m.Story, Relevance: 1}
+		if best > 0 {
+			r.Relevance = m.Relevance / best
+		}
+
+		switch action {
+		case RuleBoost:
+			r.Interest = 1
+		case RuleFilter:
+			r.Interest = 0
+		default:
+			r.Interest = session.storyInterest(m.Story)
+		}
+		r.Score = (1-searchInterestWeight)*r.Relevance + searchInterestWeight*r.Interest
+		ret = append(ret, r)
+	}
+
+	sort.Stable(searchResults(ret))
+	return ret
+}
@@ -4,9 +4,11 @@ import (
 	"bread/config"
 	"bread/db"
 	"bread/nbc"
+	"bread/recommend"
 	"bread/story"
 	"bytes"
 	"cache"
+	"context"
 	"encoding/gob"
 	"log"
 	"net/http"
@@ -28,16 +30,23 @@ const (
 
 const storiesPerPage = 10
 const interestingPerPage = 2
+const readPerPage = 20
 
 type Session struct {
 	id          string
 	isNew       bool
+	modified    bool // Indicates the session needs to be copied back to the db
 	classifier  *nbc.Classifier
-	haveRead    map[int64]bool // Stories that have been read
-	haveIgnored map[int64]bool // Stories that have been ignored
-	filtered    []*story.Story // The current filtered stories
-	unfiltered  []*story.Story // The current unfiltered stories
-	haveBrowsed int64          // Keep track of how far a user has browsed
+	haveRead    map[int64]bool  // Stories that have been read
+	haveIgnored map[int64]bool  // Stories that have been ignored
+	upvoted     map[int64]bool  // Stories upvoted since the session was read
+	saved       map[int64]bool  // Stories saved to read later
+	pinned      map[string]bool // Words that make stories interesting
+	blocked     map[string]bool // Words that make stories uninteresting
+	rules       []*Rule         // Filter rules applied before the classifier
+	filtered    []*story.Story  // The current filtered stories
+	unfiltered  []*story.Story  // The current unfiltered stories
+	haveBrowsed int64           // Keep track of how far a user has browsed
 
 	// A marker used to minimise the search for interesting stories
 	haveClassified int64
@@ -64,26 +73,62 @@ type StoryIndex struct {
 	HaveNext     bool
 	Filtered     []*story.Story
 	Unfiltered   []*story.Story
+	Recommended  []*story.Story           // Read by users who read the same stories
+	Alternates   map[int64][]*story.Story // Duplicates of the stories shown
+	Saved        map[int64]bool           // The stories shown that are saved
+}
+
+// A page of read stories
+type ReadIndex struct {
+	Query        string // The search, if any, the stories match
+	Previous     int
+	Next         int
+	HavePrevious bool
+	HaveNext     bool
+	Stories      []*story.Story
 }
 
 type UserProfile struct {
 	Interesting   WordCounts
 	Uninteresting WordCounts
+	Pinned        []string
+	Blocked       []string
+	Rules         []Rule
+	Decay         string
+	HalfLife      float64
+	History       []VocabularySnapshot
 }
 
 var stories = newFifo(MaxStories)
 
 // Sessions are held in the DB and are cached in memory
-var sessions = cache.New(1024, 5*time.Minute, readSession, saveSession)
+var sessions = cache.NewSharded(sessionShards, 1024, 5*time.Minute, readSession, saveSession)
+
+// The number of independent shards of the session cache
+const sessionShards = 8
+
+// How long a request waits for its session to be read from the db
+const sessionTimeout = 10 * time.Second
 
 var storyCh = make(chan []*story.Story)
 var readCh = make(chan userStory, 8)
+var stopCh = make(chan chan bool)
 
 // Add stories so that they are available to all users
 func AddStories(s []*story.Story) {
 	storyCh <- s
 }
 
+// Add the terms of a story's article to the story's word list
+func AddTerms(storyid int64, terms []string) {
+	stories.mutex.Lock()
+	defer stories.mutex.Unlock()
+
+	if s, ok := stories.get(storyid); ok {
+		stories.set(s.WithTerms(terms))
+	}
+}
+
 // Mark a story as read
 func MarkRead(w http.ResponseWriter, req *http.Request, storyid int64) {
 
@@ -102,27 +147,37 @@ func markRead(sessionid string, storyid int64) {
 	defer session.release()
 
 	if !session.haveRead[storyid] {
-		session.classifyStory(storyid, Interesting)
+		// Upvoted stories have already been trained
+		if !session.upvoted[storyid] {
+			session.classifyStory(storyid, Interesting)
+		}
+		session.modified = true
 		session.haveRead[storyid] = true
 		session.haveClassified = 0
+		everyone.read(storyid)
 		if session.haveIgnored[storyid] {
 			delete(session.haveIgnored, storyid)
 		}
+		if session.saved[storyid] {
+			unsave(session, storyid)
+		}
 		db.MarkRead(sessionid, storyid)
 	}
 }
 
-// Indicate that a user has browsed up to the given storyid 
-func MarkBrowsed(w http.ResponseWriter, req *http.Request, storyid int64) {
+// Indicate that a user has browsed up to the given storyid, returns false
+// if there is no session
+func MarkBrowsed(w http.ResponseWriter, req *http.Request, storyid int64) bool {
 
 	session, ok := getSession(w, req)
 	if !ok {
-		return
+		return false
 	}
 
 	defer session.release()
 
 	markBrowsed(session, storyid)
+	return true
 }
 
 // Indicate that a user has browsed up to the given storyid 
@@ -148,14 +203,14 @@ func markBrowsed(session *Session, storyid int64) {
 	}
 
 	// Loop through the filtered and unfiltered stories and mark 
-	// the unread ones as uninteresting
+	// the unread ones as uninteresting, saved stories are left for later
 	for _, s := range session.filtered {
 		i := s.Id
 		if i < session.haveBrowsed {
 			config.Debug("Not uninteresting: ", i)
 			continue
 		}
-		if !session.haveRead[i] && !session.haveIgnored[i] {
+		if !session.haveRead[i] && !session.haveIgnored[i] && !session.saved[i] {
 			session.classifyStory(i, Uninteresting)
 			session.haveIgnored[i] = true
 		}
@@ -167,7 +222,7 @@ func markBrowsed(session *Session, storyid int64) {
 			config.Debug("Not uninteresting: ", i)
 			continue
 		}
-		if !session.haveRead[i] && !session.haveIgnored[i] {
+		if !session.haveRead[i] && !session.haveIgnored[i] && !session.saved[i] {
 			session.classifyStory(i, Uninteresting)
 		}
 	}
@@ -178,6 +233,7 @@ func markBrowsed(session *Session, storyid int64) {
 
 	// Keep track of how far the user has browsed
 	session.haveBrowsed = storyid - 1
+	session.modified = true
 }
 
 // Create a session
@@ -188,30 +244,46 @@ func create(s *Session) {
 // Create a story index
 func NewStoryIndex() *StoryIndex {
 	ret := &StoryIndex{Filtered: make([]*story.Story, 0, storiesPerPage),
-		Unfiltered: make([]*story.Story, 0, storiesPerPage)}
+		Unfiltered: make([]*story.Story, 0, storiesPerPage),
+		Recommended: make([]*story.Story, 0, recommendedPerPage),
+		Alternates:  make(map[int64][]*story.Story),
+		Saved:       make(map[int64]bool)}
 	return ret
 }
 
-// Get stories that have been read
-func HaveReadStories(w http.ResponseWriter, req *http.Request) *StoryIndex {
+// Get a page of the stories that have been read, optionally only those
+// matching a search
+func HaveReadStories(w http.ResponseWriter, req *http.Request, page int, query string) (*ReadIndex, bool) {
 
-	ret := NewStoryIndex()
+	ret := &ReadIndex{Query: query}
 
 	session, ok := getSession(w, req)
 	if !ok {
-		return ret
+		return nil, false
 	}
 
 	defer session.release()
 
-	// Get the read stories from the db
-	read := db.AllRead(session.id)
+	// Get one more story than needed to find out if there is a next page
+	offset := page * readPerPage
+	if query == "" {
+		ret.Stories = db.ReadHistory(session.id, offset, readPerPage+1)
+	} else {
+		ret.Stories = db.SearchRead(session.id, query, offset, readPerPage+1)
+	}
 
-	for _, s := range read {
-		ret.Unfiltered = append(ret.Unfiltered, s)
+	if len(ret.Stories) > readPerPage {
+		ret.Stories = ret.Stories[:readPerPage]
+		ret.Next = page + 1
+		ret.HaveNext = true
 	}
 
-	return ret
+	if page > 0 {
+		ret.Previous = page - 1
+		ret.HavePrevious = true
+	}
+
+	return ret, true
 }
 
 // Get a story
@@ -236,24 +308,45 @@ func GetStory(storyid int64) (*story.Story, bool) {
 }
 
 // Get the profile for a user
-func Profile(w http.ResponseWriter, r *http.Request) *UserProfile {
+func Profile(w http.ResponseWriter, r *http.Request) (*UserProfile, bool) {
 
 	session, session_ok := getSession(w, r)
 	if !session_ok {
-		return &UserProfile{Interesting: make([]WordCount, 0), Uninteresting: make([]WordCount, 0)}
+		return nil, false
 	}
 
 	defer session.release()
 	ret := new(UserProfile)
 
-	// Get the interesting class
-	ret.Interesting = mapToWordCount(session.classifier.WordsInClass(Interesting), 1)
-	ret.Uninteresting = mapToWordCount(session.classifier.WordsInClass(Uninteresting), 1)
+	// Get the interesting class, pinned and blocked words are listed separately
+	interesting := session.classifier.WordsInClass(Interesting)
+	uninteresting := session.classifier.WordsInClass(Uninteresting)
+	for w := range session.pinned {
+		delete(interesting, w)
+		delete(uninteresting, w)
+	}
+	for w := range session.blocked {
+		delete(interesting, w)
+		delete(uninteresting, w)
+	}
+
+	ret.Interesting = mapToWordCount(interesting, 1)
+	ret.Uninteresting = mapToWordCount(uninteresting, 1)
+	ret.Pinned = sortedWords(session.pinned)
+	ret.Blocked = sortedWords(session.blocked)
+	ret.Rules = make([]Rule, 0, len(session.rules))
+	for _, r := range session.rules {
+		ret.Rules = append(ret.Rules, *r)
+	}
+
+	ret.Decay = decayName(session.classifier.Decay)
+	ret.HalfLife = session.classifier.HalfLife
+	ret.History = exportHistory(session.classifier)
 
 	ret.Interesting.Sort()
 	ret.Uninteresting.Sort()
 
-	return ret
+	return ret, true
 }
 
 // Convert a map of wordcounts into a slice of WordCount
@@ -283,7 +376,7 @@ func interesting(session *Session, start int64) []*story.Story {
 	}
 
 	for i := start; i < stories.end; i++ {
-		if session.haveRead[i] || session.haveIgnored[i] {
+		if session.haveRead[i] || session.haveIgnored[i] || session.saved[i] || dups.isDuplicate(i) {
 			continue
 		}
 		story, ok := stories.get(i)
@@ -291,8 +384,11 @@ func interesting(session *Session, start int64) []*story.Story {
 			break
 		}
 
-		class := session.classifier.Classify(story.Wordlist)
-		if class == Interesting {
+		if session.hidden(story) {
+			continue
+		}
+
+		if session.isInteresting(story) {
 			config.Debug("Interesting:", story.Rss.Title)
 			ret = append(ret, story)
 			if len(ret) == interestingPerPage {
@@ -317,13 +413,19 @@ func unfiltered(s *Session, haveSession bool, start int64, n int, ignore map[int
 		if ignore != nil && ignore[i] {
 			continue
 		}
-		if haveSession && (s.haveRead[i] || s.haveIgnored[i]) {
+		if haveSession && (s.haveRead[i] || s.haveIgnored[i] || s.saved[i]) {
+			continue
+		}
+		if dups.isDuplicate(i) {
 			continue
 		}
 		story, ok := stories.get(i)
 		if !ok {
 			break
 		}
+		if haveSession && s.hidden(story) {
+			continue
+		}
 		ret = append(ret, story)
 	}
 
@@ -331,22 +433,23 @@ func unfiltered(s *Session, haveSession bool, start int64, n int, ignore map[int
 }
 
 // Get the interesting stories starting at the given story
-func FilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) *StoryIndex {
+func FilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) (*StoryIndex, bool) {
 
-	// Get the users session if possible
+	// Get the users session
 	session, session_ok := getSession(w, req)
-
-	if session_ok {
-		defer session.release()
+	if !session_ok {
+		return nil, false
 	}
 
+	defer session.release()
+
 	// We are about to access stories
 	stories.mutex.RLock()
 	defer stories.mutex.RUnlock()
 
 	// Try and start the index at the latest browsed story if no story is specified
 	start := storyid
-	if session_ok && storyid == 0 {
+	if storyid == 0 {
 		if session.haveBrowsed > 0 {
 			start = session.haveBrowsed + 1
 		} else {
@@ -359,9 +462,7 @@ func FilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) *S
 	ret := NewStoryIndex()
 
 	// Get stories 
-	if !session_ok {
-		ret.Unfiltered = unfiltered(nil, false, start, storiesPerPage, nil)
-	} else if len(session.filtered) > 0 || len(session.unfiltered) > 0 {
+	if len(session.filtered) > 0 || len(session.unfiltered) > 0 {
 		ret.Filtered = session.filtered
 		ret.Unfiltered = session.unfiltered
 	} else {
@@ -372,27 +473,48 @@ func FilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) *S
 		session.unfiltered = ret.Unfiltered
 	}
 
+	// Recommend stories that are not already on the page
+	onPage := storyIdMap(ret.Filtered)
+	for _, s := range ret.Unfiltered {
+		onPage[s.Id] = true
+	}
+	ret.Recommended = recommended(session, recommendedPerPage, onPage)
+
+	ret.Alternates = dups.alternatesOf(ret.Filtered)
+	for id, alts := range dups.alternatesOf(ret.Unfiltered) {
+		ret.Alternates[id] = alts
+	}
+
+	// Stories saved since the page was built stay on it
+	for _, s := range ret.Filtered {
+		ret.Saved[s.Id] = session.saved[s.Id]
+	}
+	for _, s := range ret.Unfiltered {
+		ret.Saved[s.Id] = session.saved[s.Id]
+	}
+
 	previousNext(ret, start)
-	return ret
+	return ret, true
 }
 
 // Get all stories starting at the given story
-func UnfilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) *StoryIndex {
+func UnfilteredStories(w http.ResponseWriter, req *http.Request, storyid int64) (*StoryIndex, bool) {
 
-	// Get the users session if possible
+	// Get the users session
 	session, session_ok := getSession(w, req)
-
-	if session_ok {
-		defer session.release()
+	if !session_ok {
+		return nil, false
 	}
 
+	defer session.release()
+
 	// We are about to access stories
 	stories.mutex.RLock()
 	defer stories.mutex.RUnlock()
 
 	// Try and start the index at the latest browsed story if no story is specified
 	start := storyid
-	if session_ok && storyid == 0 {
+	if storyid == 0 {
 		start = session.haveBrowsed + 1
 		log.Println("Building story index starting from", start)
 	}
@@ -402,10 +524,11 @@ func UnfilteredStories(w http.ResponseWriter, req *http.Request, storyid int64)
 
 	// Get stories 
 	ret.Unfiltered = unfiltered(nil, false, start, storiesPerPage, nil)
+	ret.Alternates = dups.alternatesOf(ret.Unfiltered)
 	session.unfiltered = ret.Unfiltered
 
 	previousNext(ret, start)
-	return ret
+	return ret, true
 }
 
 // Calculate previous and next links and add them to the given story index
@@ -441,6 +564,8 @@ func previousNext(i *StoryIndex, start int64) {
 
 // Fufil session requests in the background
 func backgroundRequests() {
+	tick := time.Tick(crowdTrainPeriod)
+
 	for {
 		select {
 		case s := <-storyCh:
@@ -449,6 +574,28 @@ func backgroundRequests() {
 		case mr := <-readCh:
 			// Mark a story as read
 			markRead(mr.sessionid, mr.storyid)
+		case <-tick:
+			// Train the global classifier
+			everyone.trainQueued()
+		case done := <-stopCh:
+			drainRequests()
+			done <- true
+			return
+		}
+	}
+}
+
+// Complete any queued background requests
+func drainRequests() {
+	for {
+		select {
+		case s := <-storyCh:
+			addStories(s)
+		case mr := <-readCh:
+			markRead(mr.sessionid, mr.storyid)
+		default:
+			everyone.trainQueued()
+			return
 		}
 	}
 }
@@ -460,20 +607,20 @@ func addStories(s []*story.Story) {
 
 	for _, story := range s {
 		stories.add(story)
+		dups.add(story)
 	}
 
+	everyone.expire(stories.start)
+	dups.expire(stories.start)
+	recommend.SetStart(stories.start)
+
 	config.Debug("Added ", len(s), "new stories")
 	config.Debug("start =", stories.start, ", end =", stories.end)
 }
 
 // Asynchronously get the sesson with the given id
 func sessionAsync(sessionid string) (*Session, bool) {
-	s, ok := sessions.GetAsync(sessionid)
-	if !ok {
-		return nil, false
-	}
-
-	ret, ok := s.(*Session)
+	ret, ok := sessions.GetAsync(sessionid)
 	if !ok {
 		return nil, false
 	}
@@ -483,19 +630,17 @@ func sessionAsync(sessionid string) (*Session, bool) {
 }
 
 // Synchronously get the sesson with the given id
-func sessionSync(sessionid string) (*Session, bool) {
-	s, ok := sessions.Get(sessionid)
-	if !ok {
-		return nil, false
-	}
+func sessionSync(ctx context.Context, sessionid string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, sessionTimeout)
+	defer cancel()
 
-	ret, ok := s.(*Session)
-	if !ok {
-		return nil, false
+	ret, err := sessions.GetContext(ctx, sessionid)
+	if err != nil {
+		return nil, err
 	}
 
 	ret.mutex.Lock()
-	return ret, ok
+	return ret, nil
 }
 
 // Mark a story as Interesting/Uninteresting
@@ -511,35 +656,53 @@ func (s *Session) classifyStory(story int64, class int) {
 	}
 
 	s.classifier.Train(sty.Wordlist, class)
+	everyone.train(sty.Wordlist, class)
 }
 
 // Unlock a session so that it can be accessed by other goroutines
 func (s *Session) release() {
+	modified := s.modified
+	s.modified = false
 	s.mutex.Unlock()
+
+	// Tell the cache after unlocking, a copy back needs the lock
+	if modified {
+		sessions.Modified(s.id)
+	}
 }
 
 // Read a session from the db
-func readSession(key string) (cache.Entry, bool) {
+func readSession(key string) (*Session, error) {
 	dbs, ok := db.GetSession(key)
 	if !ok {
 		log.Println("Failed to read session ", key, " from db")
-		return nil, false
+		return nil, cache.ErrNotFound
 	}
 
 	// Convert the session from db format
 	// Deserialize the classsifier
 	classifier, err := nbc.Deserialise(dbs.Classifier)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
 
 	// Get the read stories
 	read := getReadMap(key)
 
+	pinned, blocked, err := deserialiseWords(dbs.Words)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := deserialiseRules(dbs.Rules)
+	if err != nil {
+		return nil, err
+	}
+
 	// Deserialise ignored stories
 	ignored, err := deserialiseStoryMap(dbs.HaveIgnored)
 	if err != nil {
-		return nil, false
+		return nil, err
 	}
 
 	config.Debug("Deserialised classifier: ", classifier)
@@ -550,21 +713,24 @@ func readSession(key string) (cache.Entry, bool) {
 		classifier:     classifier,
 		haveRead:       read,
 		haveIgnored:    ignored,
+		upvoted:        make(map[int64]bool),
+		saved:          getSavedMap(key),
+		pinned:         pinned,
+		blocked:        blocked,
+		rules:          rules,
 		haveClassified: dbs.HaveClassified,
 		haveBrowsed:    dbs.HaveBrowsed}
 
 	ret.filtered = make([]*story.Story, 0, storiesPerPage)
 	ret.unfiltered = make([]*story.Story, 0, storiesPerPage)
-	return ret, true
+	return ret, nil
 }
 
 // Save a session to the db
-func saveSession(c cache.Entry) {
-	// Convert from the cache format to a session
-	session, ok := c.(*Session)
-	if !ok {
-		log.Fatal("Cannot convert cache.Entry to *Session")
-	}
+func saveSession(session *Session) {
+	// The session can be in use while it is copied back
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
 
 	config.Debug("Saving session ", session.id)
 	config.Debug("Writing classifier:")
@@ -582,6 +748,14 @@ func saveSession(c cache.Entry) {
 	if err != nil {
 		return
 	}
+	wbytes, err := serialiseWords(session.pinned, session.blocked)
+	if err != nil {
+		return
+	}
+	rbytes, err := serialiseRules(session.rules)
+	if err != nil {
+		return
+	}
 
 	// Write the session
 	dbs := db.Session{
@@ -589,10 +763,13 @@ func saveSession(c cache.Entry) {
 		Classifier:     cbytes,
 		HaveIgnored:    ibytes,
 		HaveClassified: session.haveClassified,
-		HaveBrowsed:    session.haveBrowsed}
+		HaveBrowsed:    session.haveBrowsed,
+		Words:          wbytes,
+		Rules:          rbytes}
 
 	if session.isNew {
 		db.CreateSession(&dbs)
+		session.isNew = false
 	} else {
 		db.WriteSession(&dbs)
 	}
@@ -669,11 +846,28 @@ func getReadMap(sessionid string) map[int64]bool {
 
 // Start the go routine that wraps the session
 func Start() {
+	sessions.SetWriteThrough(config.WriteThrough)
+	sessions.SetNotFoundTTL(config.NotFoundTTL)
 	setupCookies()
 	initFifo()
+	initCrowd()
 	go backgroundRequests()
 }
 
+// Stop the background go routine and copy back modified sessions
+func Stop() {
+	done := make(chan bool)
+	stopCh <- done
+	<-done
+
+	sessions.FlushAll()
+}
+
+// Get the statistics of the session cache
+func CacheStats() cache.Stats {
+	return sessions.Stats()
+}
+
 // Fill the Fifo from the db
 func initFifo() {
 	s := db.GetLatestStories(MaxStories)
@@ -681,7 +875,10 @@ func initFifo() {
 	// Add the stories in reverse order
 	for i := len(s) - 1; i >= 0; i-- {
 		stories.add(s[i])
+		dups.add(s[i])
 	}
+
+	recommend.SetStart(stories.start)
 }
 
 func max(a int64, b int64) int64 {
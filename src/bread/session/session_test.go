@@ -1,16 +1,34 @@
 package session
 
 import (
+	"bread/config"
+	"bread/db"
+	"bread/rss"
 	"bread/story"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
+// A store that ignores writes, unused requests are not implemented
+type testStore struct {
+	db.Store
+}
+
+func (t testStore) MarkRead(sessionid string, storyid int64)    {}
+func (t testStore) SaveStory(sessionid string, storyid int64)   {}
+func (t testStore) UnsaveStory(sessionid string, storyid int64) {}
+
 var storyOne = &story.Story{Id: 1, Wordlist: []string{"fox", "jumped", "cat"}}
 var storyTwo = &story.Story{Id: 2, Wordlist: []string{"cow", "jumped", "moon"}}
 var storyThree = &story.Story{Id: 3, Wordlist: []string{"man", "shoots", "cat"}}
 
 func TestReading(t *testing.T) {
 
+	db.Use(testStore{})
+
 	stories.add(storyOne)
 	stories.add(storyTwo)
 	stories.add(storyThree)
@@ -73,3 +91,508 @@ func TestFifoAdd(t *testing.T) {
 		t.Error("fifo wrap around: ", fifo.start, " --> ", fifo.end)
 	}
 }
+
+func TestFifoSet(t *testing.T) {
+	fifo := newFifo(2)
+	fifo.add(story1)
+	fifo.add(story2)
+	fifo.add(story3)
+
+	if !fifo.set(story3.WithTerms([]string{"article"})) {
+		t.Error("Cannot replace a story in the fifo")
+	}
+	if s, _ := fifo.get(story3.Id); len(s.Terms) != 1 || s.Wordlist[3] != "article" {
+		t.Error("Replaced story does not have its terms:", s)
+	}
+	if len(story3.Terms) != 0 {
+		t.Error("Original story changed by WithTerms")
+	}
+
+	if fifo.set(story1) {
+		t.Error("Replaced a story that has left the fifo")
+	}
+}
+
+func TestRankMatches(t *testing.T) {
+	sess := newSession()
+	sess.classifier.Train(storyOne.Wordlist, Interesting)
+	sess.classifier.Train(storyTwo.Wordlist, Uninteresting)
+
+	matches := []*db.Match{
+		{Story: storyTwo, Relevance: 2},
+		{Story: storyOne, Relevance: 2},
+		{Story: storyThree, Relevance: 1}}
+
+	results := rankMatches(sess, matches)
+
+	if len(results) != 3 {
+		t.Fatal("Wrong number of ranked results: ", len(results))
+	}
+
+	if results[0].Story != storyOne || results[1].Story != storyTwo {
+		t.Error("Interest did not break a relevance tie: ",
+			results[0].Story.Id, ", ", results[1].Story.Id)
+	}
+
+	if results[0].Relevance != 1 || results[2].Relevance != 0.5 {
+		t.Error("Relevance not scaled by the best match: ",
+			results[0].Relevance, ", ", results[2].Relevance)
+	}
+}
+
+func TestProfileFormat(t *testing.T) {
+	c := newClassifier()
+	c.Train(story1.Wordlist, Interesting)
+	c.Train(story2.Wordlist, Uninteresting)
+	c.Train(story4.Wordlist, Uninteresting)
+
+	// Export and import the classifier through JSON
+	exported := &ExportedProfile{
+		Version: ProfileVersion,
+		Classifier: ExportedClassifier{
+			Total:         c.Total,
+			Words:         c.Words,
+			Interesting:   exportClass(&c.Classes[Interesting]),
+			Uninteresting: exportClass(&c.Classes[Uninteresting])}}
+
+	b, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p ExportedProfile
+	if err := json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.validate(); err != nil {
+		t.Error("Exported profile is not valid:", err)
+	}
+
+	imported := p.Classifier.classifier()
+	if imported.Total != 3 || imported.Classes[Uninteresting].Frequency("cow") != 1 {
+		t.Error("Imported classifier differs:", imported)
+	}
+
+	if imported.Classify(story3.Wordlist) != c.Classify(story3.Wordlist) {
+		t.Error("Imported classifier classifies differently")
+	}
+
+	// Profiles exported before examples could fade have no decayed counts
+	p.Classifier.Interesting.Decayed = 0
+	if imported = p.Classifier.classifier(); imported.Classes[Interesting].Decayed != 1 {
+		t.Error("Decayed count not taken from the count:", imported.Classes[Interesting])
+	}
+
+	p.Classifier.Decay = "sometimes"
+	if p.validate() == nil {
+		t.Error("Profile with an unknown decay is valid")
+	}
+	p.Classifier.Decay = "none"
+
+	// Profiles that cannot be imported
+	p.Version = ProfileVersion + 1
+	if p.validate() == nil {
+		t.Error("Profile with a newer version is valid")
+	}
+
+	p.Version = 0
+	if p.validate() == nil {
+		t.Error("Profile without a version is valid")
+	}
+
+	p.Version = ProfileVersion
+	p.Classifier.Total = 1
+	if p.validate() == nil {
+		t.Error("Profile with an inconsistent classifier is valid")
+	}
+}
+
+func TestImportHostile(t *testing.T) {
+	// Negative counts are refused
+	payload := `{"version": 2, "classifier": {"total": 1, "words": 1, "decay": "none",
+		"interesting": {"count": 1, "decayed": 1, "vocabulary": {"cow": -1000}},
+		"uninteresting": {"count": 0, "decayed": 0, "vocabulary": {}}}}`
+
+	var p ExportedProfile
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.validate() == nil {
+		t.Error("Profile with a negative word count is valid")
+	}
+
+	p.Classifier.Interesting.Vocabulary["cow"] = 1
+	if err := p.validate(); err != nil {
+		t.Fatal("Profile is not valid:", err)
+	}
+
+	// Counts that are not numbers are refused
+	for _, bad := range []float64{math.NaN(), math.Inf(1), -1} {
+		p.Classifier.Uninteresting.Vocabulary["cow"] = bad
+		if p.validate() == nil {
+			t.Error("Profile with word count", bad, "is valid")
+		}
+		delete(p.Classifier.Uninteresting.Vocabulary, "cow")
+
+		p.Classifier.Uninteresting.Decayed = bad
+		if p.validate() == nil {
+			t.Error("Profile with decayed count", bad, "is valid")
+		}
+		p.Classifier.Uninteresting.Decayed = 0
+	}
+
+	p.Classifier.Interesting.Count = -1
+	p.Classifier.Uninteresting.Count = 2
+	if p.validate() == nil {
+		t.Error("Profile with a negative class count is valid")
+	}
+	p.Classifier.Interesting.Count = 1
+	p.Classifier.Uninteresting.Count = 0
+
+	p.Classifier.HalfLife = math.NaN()
+	if p.validate() == nil {
+		t.Error("Profile with an invalid half life is valid")
+	}
+}
+
+func TestWords(t *testing.T) {
+	sess := newSession()
+	sess.classifier.Train(story1.Wordlist, Interesting)
+	sess.classifier.Train(story2.Wordlist, Uninteresting)
+
+	if sess.classify(story2.Wordlist) != Uninteresting {
+		t.Error("Classifier not used without pinned or blocked words")
+	}
+
+	// Pinned words make stories interesting
+	sess.pinned["moon"] = true
+	if sess.classify(story2.Wordlist) != Interesting || sess.interest(story2.Wordlist) != 1 {
+		t.Error("Story with a pinned word is not interesting")
+	}
+
+	// Blocking takes precedence over pinning
+	sess.blocked["cow"] = true
+	if sess.classify(story2.Wordlist) != Uninteresting || sess.interest(story2.Wordlist) != 0 {
+		t.Error("Story with a blocked word is not uninteresting")
+	}
+
+	// Words are stored with the session
+	b, err := serialiseWords(sess.pinned, sess.blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned, blocked, err := deserialiseWords(b)
+	if err != nil || !pinned["moon"] || !blocked["cow"] || len(pinned)+len(blocked) != 2 {
+		t.Error("Words were not deserialised:", pinned, blocked, err)
+	}
+
+	// Sessions stored before words could be pinned have none
+	pinned, blocked, err = deserialiseWords(nil)
+	if err != nil || len(pinned) != 0 || len(blocked) != 0 {
+		t.Error("Words were deserialised from nothing:", pinned, blocked, err)
+	}
+
+	// Words entered by users are normalised like the words of stories
+	for entered, want := range map[string]string{"Moon": "moon", " (moon), ": "moon", "go,": "go", "AWS": "aws", "rust": "rust"} {
+		if w, err := normaliseWord(entered); err != nil || w != want {
+			t.Error("Word", entered, "normalised to", w, err)
+		}
+	}
+
+	for _, entered := range []string{"", "x", "(!)", "1,000", "cow moon"} {
+		if w, err := normaliseWord(entered); err == nil {
+			t.Error("Word", entered, "normalised to", w)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	bad := []Rule{
+		{Field: "body", Match: RuleKeyword, Pattern: "cat", Action: RuleHide},
+		{Field: RuleTitle, Match: "glob", Pattern: "cat", Action: RuleHide},
+		{Field: RuleTitle, Match: RuleKeyword, Pattern: "", Action: RuleHide},
+		{Field: RuleTitle, Match: RuleRegexp, Pattern: "(", Action: RuleHide},
+		{Field: RuleTitle, Match: RuleKeyword, Pattern: "cat", Action: "star"}}
+	for _, r := range bad {
+		if r.compile() == nil {
+			t.Error("Invalid rule compiled:", r)
+		}
+	}
+
+	s := &story.Story{Id: 4, Wordlist: []string{"fox", "cat"}, Rss: rss.Story{
+		Title:   "The Fox and the Cat",
+		Summary: "<p>A fable</p>",
+		Text:    "A fable",
+		Link:    "https://news.example.com/fable"}}
+
+	sess := newSession()
+	sess.classifier.Train(s.Wordlist, Interesting)
+
+	// Keyword rules ignore case, hosts are matched without the path
+	sess.rules = compileRules([]Rule{
+		{Field: RuleTitle, Match: RuleKeyword, Pattern: "fox", Action: RuleFilter}})
+	if sess.isInteresting(s) || sess.hidden(s) {
+		t.Error("Filtered story is interesting or hidden")
+	}
+
+	sess.rules = compileRules([]Rule{
+		{Field: RuleHost, Match: RuleRegexp, Pattern: `^news\.`, Action: RuleBoost},
+		{Field: RuleSummary, Match: RuleKeyword, Pattern: "fable", Action: RuleHide}})
+	if !sess.hidden(s) {
+		t.Error("Hiding does not take precedence")
+	}
+
+	// Filtering takes precedence over boosting
+	sess.rules[1].Action = RuleFilter
+	if sess.isInteresting(s) {
+		t.Error("Filtering does not take precedence")
+	}
+
+	// Rules are stored with the session
+	b, err := serialiseRules(sess.rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := deserialiseRules(b)
+	if err != nil || len(rules) != 2 || rules[0].re == nil || rules[1].Action != RuleFilter {
+		t.Error("Rules were not deserialised:", rules, err)
+	}
+
+	// Sessions stored before rules could be added have none
+	rules, err = deserialiseRules(nil)
+	if err != nil || len(rules) != 0 {
+		t.Error("Rules were deserialised from nothing:", rules, err)
+	}
+}
+
+func TestPopularity(t *testing.T) {
+	everyone.readers = map[int64]int{story1.Id: popularReaders}
+	defer func() { everyone.readers = make(map[int64]int) }()
+
+	// New users are shown what others read
+	sess := newSession()
+	if !sess.isInteresting(story1) || sess.isInteresting(story2) {
+		t.Error("New user not shown popular stories")
+	}
+
+	// Users with a little training blend in their own classifier
+	sess.classifier.Train(story2.Wordlist, Interesting)
+	sess.classifier.Train(story1.Wordlist, Uninteresting)
+	p := sess.storyInterest(story1)
+	if p <= sess.interest(story1.Wordlist) || p >= everyone.interest(story1) {
+		t.Error("Interest not blended:", p)
+	}
+
+	// Trained users only use their own classifier
+	for i := 0; i < matureExamples; i++ {
+		sess.classifier.Train(story1.Wordlist, Uninteresting)
+	}
+
+	if sess.maturity() != 1 || sess.isInteresting(story1) {
+		t.Error("Trained user shown a popular story")
+	}
+
+	everyone.expire(story2.Id)
+	if len(everyone.readers) != 0 {
+		t.Error("Readers of expired stories kept:", everyone.readers)
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	d := newDuplicates()
+	first := &story.Story{Id: 10, Rss: rss.Story{Title: "First", Link: "http://a.com/story?utm_source=rss"}}
+	second := &story.Story{Id: 11, Rss: rss.Story{Title: "Second", Link: "https://www.a.com/story"}}
+	other := &story.Story{Id: 12, Rss: rss.Story{Title: "Other", Link: "http://b.com/story"}}
+
+	d.add(first)
+	d.add(second)
+	d.add(other)
+
+	if d.isDuplicate(first.Id) || !d.isDuplicate(second.Id) || d.isDuplicate(other.Id) {
+		t.Error("Wrong duplicates:", d.primary)
+	}
+
+	if alts := d.alternates[first.Id]; len(alts) != 1 || alts[0] != second.Id {
+		t.Error("Wrong alternates:", alts)
+	}
+
+	if others := d.others(second.Id); len(others) != 1 || others[0] != first.Id {
+		t.Error("Wrong stories in cluster:", others)
+	}
+
+	// Stories that leave the fifo are forgotten
+	d.expire(second.Id + 1)
+	if len(d.primary) != 0 || len(d.alternates) != 0 {
+		t.Error("Expired clusters kept:", d.primary, d.alternates)
+	}
+}
+
+func TestVote(t *testing.T) {
+	sess := newSession()
+
+	vote(sess, storyThree.Id, Interesting)
+	vote(sess, storyThree.Id, Interesting)
+	if !sess.upvoted[storyThree.Id] || sess.classifier.Total != 1 {
+		t.Error("Upvote not counted once:", sess.classifier.Total)
+	}
+
+	vote(sess, storyThree.Id, Uninteresting)
+	vote(sess, storyThree.Id, Uninteresting)
+	if sess.upvoted[storyThree.Id] || !sess.haveIgnored[storyThree.Id] || sess.classifier.Total != 2 {
+		t.Error("Downvote not counted once:", sess.classifier.Total)
+	}
+
+	if c, _ := sess.contributions(storyThree); len(c) != 0 {
+		t.Error("Words for a downvoted story:", c)
+	}
+}
+
+func TestSimilar(t *testing.T) {
+	sess := newSession()
+	st := &story.Story{Id: 99, Wordlist: []string{"jumped", "cat", "fox"}}
+
+	if ss := similar(sess, st, similarPerStory); len(ss) != 1 || ss[0].Id != storyOne.Id {
+		t.Error("Wrong similar stories:", ss)
+	}
+}
+
+func TestSave(t *testing.T) {
+	db.Use(testStore{})
+
+	sess := newSession()
+	create(sess)
+	sess.filtered = []*story.Story{storyOne, storyTwo}
+
+	// Saved stories are not ignored when the user moves on
+	save(sess, storyOne.Id, false)
+	markBrowsed(sess, storyThree.Id)
+	if !sess.saved[storyOne.Id] || sess.haveIgnored[storyOne.Id] || !sess.haveIgnored[storyTwo.Id] {
+		t.Error("Saved story ignored:", sess.saved, sess.haveIgnored)
+	}
+	if sess.classifier.Total != 1 {
+		t.Error("Saved story trained:", sess.classifier.Total)
+	}
+
+	// Saving can train the story as interesting
+	save(sess, storyOne.Id, true)
+	if !sess.upvoted[storyOne.Id] || sess.classifier.Total != 2 {
+		t.Error("Saved story not trained as interesting:", sess.classifier.Total)
+	}
+
+	// Reading a saved story removes it from the reading list
+	markRead(sess.id, storyOne.Id)
+	if sess.saved[storyOne.Id] || !sess.haveRead[storyOne.Id] {
+		t.Error("Read story still saved")
+	}
+	if sess.classifier.Total != 2 {
+		t.Error("Upvoted story trained again when read:", sess.classifier.Total)
+	}
+}
+
+// A store whose sessions are corrupt, unless they do not exist
+type corruptStore struct {
+	testStore
+}
+
+func (t corruptStore) GetSession(sessionid string) (*db.Session, bool) {
+	if sessionid == "missing" {
+		return nil, false
+	}
+
+	return &db.Session{Id: sessionid, Classifier: []byte{1, 2, 3}}, true
+}
+
+func TestGetSession(t *testing.T) {
+	db.Use(corruptStore{})
+	setupCookies()
+
+	// Sessions that cannot be read are not replaced
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "id", Value: "corrupt"})
+	if _, ok := getSession(w, req); ok {
+		t.Error("Got a session that cannot be read")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Set-Cookie") != "" {
+		t.Error("Unreadable session replaced:", w.Code, w.Header())
+	}
+
+	// Callers are told there is no session so that they write nothing more
+	if _, ok := FilteredStories(httptest.NewRecorder(), req, 0); ok {
+		t.Error("Got stories without a session")
+	}
+	if Save(httptest.NewRecorder(), req, story1.Id, false) {
+		t.Error("Saved a story without a session")
+	}
+	if _, err := Rules(httptest.NewRecorder(), req); err != ErrNoSession {
+		t.Error("Got rules without a session:", err)
+	}
+
+	// Sessions that do not exist are
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "id", Value: "missing"})
+	s, ok := getSession(w, req)
+	if !ok || w.Header().Get("Set-Cookie") == "" {
+		t.Error("Missing session not replaced")
+	} else {
+		s.release()
+	}
+}
+
+// A store that keeps the global classifier
+type crowdStore struct {
+	testStore
+	classifier []byte
+}
+
+func (t *crowdStore) GetReaders(minid int64) map[int64]int { return make(map[int64]int) }
+
+func (t *crowdStore) GetGlobalClassifier() ([]byte, bool) {
+	return t.classifier, t.classifier != nil
+}
+
+func (t *crowdStore) WriteGlobalClassifier(classifier []byte) {
+	t.classifier = classifier
+}
+
+func TestCrowdTraining(t *testing.T) {
+	db.Use(&crowdStore{})
+	config.GlobalClassifier = true
+	defer func() {
+		config.GlobalClassifier = false
+		everyone.classifier = nil
+	}()
+
+	initCrowd()
+	if everyone.classifier == nil || everyone.classifier.Total != 0 {
+		t.Fatal("No new global classifier")
+	}
+
+	// Examples are queued rather than trained while serving requests
+	everyone.train(story1.Wordlist, Interesting)
+	everyone.train(story2.Wordlist, Uninteresting)
+	if everyone.classifier.Total != 0 || len(everyone.examples) != 2 {
+		t.Fatal("Global classifier trained while serving a request")
+	}
+
+	everyone.trainQueued()
+	if everyone.classifier.Total != 2 || len(everyone.examples) != 0 {
+		t.Error("Queued examples not trained:", everyone.classifier.Total, len(everyone.examples))
+	}
+
+	if len(everyone.classifier.History) != 0 {
+		t.Error("Global classifier recorded its history")
+	}
+
+	// The global classifier survives a restart
+	everyone.classifier = nil
+	initCrowd()
+	if everyone.classifier == nil || everyone.classifier.Total != 2 || !everyone.classifier.NoHistory {
+		t.Error("Global classifier not read after a restart:", everyone.classifier)
+	}
+}
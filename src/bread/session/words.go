@@ -0,0 +1,177 @@
+package session
+
+// Words a user has pinned or blocked, these override the classifier
+
+import (
+	"bread/nbc"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Actions that edit a word of a user's profile
+const (
+	PinWord     = "pin"     // Stories with the word are always interesting
+	UnpinWord   = "unpin"   // Stop pinning the word
+	BlockWord   = "block"   // Stories with the word are always uninteresting
+	UnblockWord = "unblock" // Stop blocking the word
+	DeleteWord  = "delete"  // Forget the word has been seen in a class
+)
+
+// Pinned and blocked words as they are stored in the db
+type wordLists struct {
+	Pinned  []string
+	Blocked []string
+}
+
+// Classify a story for a user. Blocked words make a story uninteresting
+// and pinned words make it interesting whatever the classifier says.
+func (s *Session) classify(words []string) int {
+	if class, ok := s.fixedClass(words); ok {
+		return class
+	}
+
+	return s.classifier.Classify(words)
+}
+
+// The probability that a user finds a story interesting
+func (s *Session) interest(words []string) float64 {
+	if class, ok := s.fixedClass(words); ok {
+		if class == Interesting {
+			return 1
+		}
+		return 0
+	}
+
+	return s.classifier.Probability(words, Interesting)
+}
+
+// Get the class of a story that contains pinned or blocked words. Blocking
+// takes precedence over pinning.
+func (s *Session) fixedClass(words []string) (int, bool) {
+	pinned := false
+	for _, w := range words {
+		if s.blocked[w] {
+			return Uninteresting, true
+		} else if s.pinned[w] {
+			pinned = true
+		}
+	}
+
+	return Interesting, pinned
+}
+
+// Normalise a word entered by a user the way the words of stories are, so
+// that it can match them. Short words are only kept as acronyms, so they are
+// normalised as if entered in capitals.
+func normaliseWord(word string) (string, error) {
+	word = strings.TrimSpace(word)
+	if word == "" || strings.ContainsAny(word, " \t") {
+		return "", errors.New("Enter a single word")
+	}
+
+	words := nbc.Wordlist(word)
+	if len(words) == 0 {
+		words = nbc.Wordlist(strings.ToUpper(word))
+	}
+	if len(words) != 1 {
+		return "", errors.New("The word is too short, a number or only punctuation")
+	}
+
+	return words[0], nil
+}
+
+// Pin, block or delete a word of a user's profile. The class is only used
+// when deleting a word.
+func EditWord(w http.ResponseWriter, req *http.Request, word, action string, class int) error {
+	word, err := normaliseWord(word)
+	if err != nil {
+		return err
+	}
+
+	session, ok := getSession(w, req)
+	if !ok {
+		return ErrNoSession
+	}
+
+	defer session.release()
+
+	switch action {
+	case PinWord:
+		delete(session.blocked, word)
+		session.pinned[word] = true
+	case UnpinWord:
+		delete(session.pinned, word)
+	case BlockWord:
+		delete(session.pinned, word)
+		session.blocked[word] = true
+	case UnblockWord:
+		delete(session.blocked, word)
+	case DeleteWord:
+		if class != Interesting && class != Uninteresting {
+			return errors.New("Unknown class")
+		}
+		session.classifier.Forget(word, class)
+	default:
+		return errors.New("Unknown action")
+	}
+
+	// Stories need to be classified again
+	session.haveClassified = 0
+	session.modified = true
+	return nil
+}
+
+// Get the words of a set in order
+func sortedWords(m map[string]bool) []string {
+	ret := make([]string, 0, len(m))
+	for w := range m {
+		ret = append(ret, w)
+	}
+
+	sort.Strings(ret)
+	return ret
+}
+
+// Make a set of words
+func wordSet(words []string) map[string]bool {
+	ret := make(map[string]bool, len(words))
+	for _, w := range words {
+		ret[w] = true
+	}
+
+	return ret
+}
+
+// Serialise pinned and blocked words
+func serialiseWords(pinned, blocked map[string]bool) ([]byte, error) {
+	var b bytes.Buffer
+	enc := gob.NewEncoder(&b)
+	err := enc.Encode(wordLists{Pinned: sortedWords(pinned), Blocked: sortedWords(blocked)})
+	if err != nil {
+		log.Println("Failed to encode words:", err)
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// Deserialise pinned and blocked words, sessions that have never pinned or
+// blocked a word have none stored
+func deserialiseWords(b []byte) (pinned, blocked map[string]bool, err error) {
+	var lists wordLists
+	if len(b) > 0 {
+		dec := gob.NewDecoder(bytes.NewReader(b))
+		err = dec.Decode(&lists)
+		if err != nil {
+			log.Println("Failed to decode words:", err)
+			return nil, nil, err
+		}
+	}
+
+	return wordSet(lists.Pinned), wordSet(lists.Blocked), nil
+}
@@ -1,20 +1,75 @@
 package story
 
 import (
+	"bread/link"
 	"bread/nbc"
 	"bread/rss"
+	"html/template"
+	"net/url"
+	"strings"
 )
 
 type Story struct {
 	Id       int64 // Numeric id assigned by the db
 	Rss      rss.Story
 	Wordlist []string
+	Terms    []string // Terms extracted from the linked article
+}
+
+// Get the host of the story's link without any www prefix
+func (s *Story) Host() string {
+	u, err := url.Parse(s.Rss.Link)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
+// Get the summary of the story for display, the rss package sanitises it
+func (s *Story) SummaryHTML() template.HTML {
+	return template.HTML(s.Rss.Summary)
+}
+
+// Get a copy of the story whose word list includes the given terms from
+// its article. Stories are shared, so they are copied rather than changed.
+func (s *Story) WithTerms(terms []string) *Story {
+	if len(terms) == 0 {
+		return s
+	}
+
+	have := make(map[string]bool, len(s.Wordlist))
+	for _, w := range s.Wordlist {
+		have[w] = true
+	}
+
+	ret := *s
+	ret.Terms = terms
+	ret.Wordlist = append(make([]string, 0, len(s.Wordlist)+len(terms)), s.Wordlist...)
+	for _, t := range terms {
+		if !have[t] {
+			ret.Wordlist = append(ret.Wordlist, t)
+			have[t] = true
+		}
+	}
+
+	return &ret
 }
 
 // Create a story from an rss story
 func FromRSS(id int64, rs *rss.Story) *Story {
 
-	wordlist := nbc.Wordlist(rs.Title + rs.Summary)
+	// Stories read from the db only have their sanitised summary
+	if rs.Text == "" {
+		rs.Text = rss.PlainText(rs.Summary)
+	}
+
+	// Stories added before links were canonicalised have no canonical link
+	if rs.Canonical == "" {
+		rs.Canonical = link.Canonical(rs.Link)
+	}
+
+	wordlist := nbc.Wordlist(rs.Title + " " + rs.Text)
 
 	return &Story{
 		Id:       id,
@@ -1,83 +1,182 @@
 /*
  An in-memory, non-blocking, Least Recently Used, time limited, copy back cache
- with thundering herd prevention.  Keys are strings.
+ with thundering herd prevention.  Typed caches have keys of any comparable
+ type, Cache is an untyped cache with string keys.
 */
 
 package cache
 
 import (
 	"container/list"
+	"context"
+	"errors"
 	"log"
 	"time"
 )
 
-// A concurrent copy back cache
-type Cache struct {
-	lines       map[string]*line
-	get         func(string) (Entry, bool)
-	getCh       chan string // A cache makes requests to get data on this channel
-	put         chan Entry  // Data can be put into a cache on this channel
-	notFound    chan string // Keys that are not found are put onto this channel
-	cp          func(Entry)
-	cpCh        chan Entry // A cache makes requests to copy modifications back on this channel
-	size        int
-	ttl         time.Duration
-	ttlPoll     <-chan time.Time
-	lruList     *list.List
-	lookupSync  chan lookup
-	lookupAsync chan lookup
-	createCh    chan create
-}
-
-// A cache entry
+// The error returned when the loader cannot find a key
+var ErrNotFound = errors.New("cache: key not found")
+
+// The error returned by asynchronous lookups when an entry is not present
+var ErrPending = errors.New("cache: entry is not present")
+
+// A concurrent copy back cache of entries of type V with keys of type K
+type Typed[K comparable, V KeyedEntry[K]] struct {
+	lines        map[K]*line[V]
+	get          func(K) (V, error)
+	getCh        chan getRequest[K] // A cache makes requests to get data on this channel
+	put          chan gotEntry[V]   // Data can be put into a cache on this channel
+	notFound     chan failure[K]    // Keys that could not be got are put onto this channel
+	loads        uint64             // The id of the last load requested
+	cp           func(V)
+	cpCh         chan copyBack[V] // A cache makes requests to copy modifications back on this channel
+	writeThrough bool             // Copy back entries as soon as they are modified
+	notFoundTTL  time.Duration    // How long keys that were not found are remembered
+	size         int
+	ttl          time.Duration
+	ttlPoll      <-chan time.Time
+	lruList      *list.List
+	lookupSync   chan lookup[K, V]
+	lookupAsync  chan lookup[K, V]
+	cancelCh     chan lookup[K, V]
+	deleteCh     chan K
+	invalidateCh chan K
+	createCh     chan create[V]
+	modifiedCh   chan K
+	flushCh      chan flush[K]
+	statsCh      chan chan Stats
+	stats        Stats // Counters owned by the cacheRequests go routine
+}
+
+// A snapshot of the statistics of a cache
+type Stats struct {
+	Lines       int    // The number of lines including empty lines
+	Waiting     int    // The number of lookups waiting on empty lines
+	Backlog     int    // The number of copy backs waiting to be made
+	Hits        uint64 // Lookups of entries that were present
+	Misses      uint64 // Lookups of entries that were not present
+	NotFound    uint64 // Keys that could not be found
+	KnownAbsent uint64 // Lookups of keys remembered as not found
+	Errors      uint64 // Keys that could not be got because of other errors
+	Evictions   uint64 // Lines removed to make space
+	Expirations uint64 // Lines removed because they exceeded the ttl
+	CopyBacks   uint64 // Copy backs of modified entries
+}
+
+// A cache entry with a key of type K
+type KeyedEntry[K comparable] interface {
+	Key() K
+}
+
+// A cache entry with a string key
 type Entry interface {
 	Key() string
 }
 
 // An augumented entry within the cache
-type line struct {
-	payload  Entry
-	empty    bool          // Indicates if this is just a placeholder
-	waiting  []chan result // Slice of channels waiting on the result
-	lruEntry *list.Element // The corresponding entry in the LRU list
-	lastUse  time.Time     // The last time this entry was used
+type line[V any] struct {
+	payload  V
+	empty    bool             // Indicates if this is just a placeholder
+	waiting  []chan result[V] // Slice of channels waiting on the result
+	lruEntry *list.Element    // The corresponding entry in the LRU list
+	lastUse  time.Time        // The last time this entry was used
+	dirty    bool             // Indicates the payload has not been copied back
+	load     uint64           // The id of the load that fills an empty line
+	notFound bool             // Indicates the key is remembered as not found
+	expires  time.Time        // When a key that was not found is forgotten
 }
 
 // A cache lookup request
-type lookup struct {
-	key   string
-	resCh chan result
+type lookup[K comparable, V any] struct {
+	key   K
+	resCh chan result[V]
 }
 
 // A create request
-type create struct {
-	entry Entry
+type create[V any] struct {
+	entry V
 	resCh chan bool
 }
 
+// A flush request for a key or for all keys
+type flush[K comparable] struct {
+	key  K
+	all  bool
+	done chan bool
+}
+
+// A copy back request. Requests with a done channel are markers that signal
+// done once all the copy backs before them have completed.
+type copyBack[V any] struct {
+	entry V
+	done  chan bool
+}
+
 // The result of a lookup request
-type result struct {
-	value Entry
-	ok    bool
-}
-
-// Create a new cache with functions to make get requests and to copy back data
-func New(size int, ttl time.Duration, get func(string) (Entry, bool), cp func(Entry)) *Cache {
-	ret := new(Cache)
-	ret.lines = make(map[string]*line)
-	ret.get = get
-	ret.getCh = make(chan string, 8)
-	ret.put = make(chan Entry, 8)
-	ret.notFound = make(chan string, 8)
-	ret.cpCh = make(chan Entry, 8)
+type result[V any] struct {
+	value V
+	err   error
+}
+
+// A request to get the entry with the given key
+type getRequest[K comparable] struct {
+	key K
+	id  uint64
+}
+
+// An entry that was got by a load
+type gotEntry[V any] struct {
+	entry V
+	id    uint64
+}
+
+// A key that could not be got
+type failure[K comparable] struct {
+	key K
+	id  uint64
+	err error
+}
+
+// Create a new typed cache with functions to make get requests and to copy
+// back data
+func NewTyped[K comparable, V KeyedEntry[K]](size int, ttl time.Duration,
+	get func(K) (V, bool), cp func(V)) *Typed[K, V] {
+	load := func(key K) (V, error) {
+		e, ok := get(key)
+		if !ok {
+			return e, ErrNotFound
+		}
+		return e, nil
+	}
+
+	return NewTypedLoader(size, ttl, load, cp)
+}
+
+// Create a new typed cache with a loader that returns an error when an entry
+// cannot be got. Loaders return ErrNotFound for keys that do not exist.
+func NewTypedLoader[K comparable, V KeyedEntry[K]](size int, ttl time.Duration,
+	load func(K) (V, error), cp func(V)) *Typed[K, V] {
+	ret := new(Typed[K, V])
+	ret.lines = make(map[K]*line[V])
+	ret.get = load
+	ret.getCh = make(chan getRequest[K], 8)
+	ret.put = make(chan gotEntry[V], 8)
+	ret.notFound = make(chan failure[K], 8)
+	ret.cpCh = make(chan copyBack[V], 8)
 	ret.cp = cp
 	ret.size = size
 	ret.ttl = ttl
 	ret.ttlPoll = time.Tick(ttl / 5)
 	ret.lruList = list.New()
-	ret.lookupSync = make(chan lookup)
-	ret.lookupAsync = make(chan lookup, 8)
-	ret.createCh = make(chan create)
+	ret.lookupSync = make(chan lookup[K, V])
+	ret.lookupAsync = make(chan lookup[K, V], 8)
+	ret.cancelCh = make(chan lookup[K, V])
+	ret.deleteCh = make(chan K)
+	ret.invalidateCh = make(chan K)
+	ret.createCh = make(chan create[V])
+	ret.modifiedCh = make(chan K)
+	ret.flushCh = make(chan flush[K])
+	ret.statsCh = make(chan chan Stats)
 
 	// Start a go routine to process cache requests
 	go cacheRequests(ret)
@@ -91,33 +190,124 @@ func New(size int, ttl time.Duration, get func(string) (Entry, bool), cp func(En
 	return ret
 }
 
-// Get an entry from the cache only if immediately available and fill the 
+// Get an entry from the cache only if immediately available and fill the
 // cache asynchronously if the key is not present
-func (c *Cache) GetAsync(key string) (value interface{}, present bool) {
-	res := make(chan result)
-	c.lookupAsync <- lookup{key: key, resCh: res}
+func (c *Typed[K, V]) GetAsync(key K) (value V, present bool) {
+	res := make(chan result[V])
+	c.lookupAsync <- lookup[K, V]{key: key, resCh: res}
 	ret := <-res
-	return ret.value, ret.ok
+	return ret.value, ret.err == nil
 }
 
 // Get an entry from the cache and synchronously get the value if not present
-func (c *Cache) Get(key string) (value interface{}, ok bool) {
-	res := make(chan result)
-	c.lookupSync <- lookup{key: key, resCh: res}
+func (c *Typed[K, V]) Get(key K) (value V, ok bool) {
+	res := make(chan result[V])
+	c.lookupSync <- lookup[K, V]{key: key, resCh: res}
 	ret := <-res
-	return ret.value, ret.ok
+	return ret.value, ret.err == nil
+}
+
+// Get an entry from the cache only if immediately available, returning
+// ErrPending and filling the cache asynchronously if the key is not present
+func (c *Typed[K, V]) GetAsyncContext(ctx context.Context, key K) (V, error) {
+	return c.lookupContext(ctx, c.lookupAsync, key)
+}
+
+// Get an entry from the cache and synchronously get the value if not
+// present. Gives up waiting when the context is done and returns the error
+// of the loader if the value cannot be got.
+func (c *Typed[K, V]) GetContext(ctx context.Context, key K) (V, error) {
+	return c.lookupContext(ctx, c.lookupSync, key)
+}
+
+// Make a lookup request that can be abandoned when the context is done
+func (c *Typed[K, V]) lookupContext(ctx context.Context, ch chan lookup[K, V], key K) (V, error) {
+	var zero V
+
+	// The result is buffered so that an abandoned lookup never blocks the cache
+	l := lookup[K, V]{key: key, resCh: make(chan result[V], 1)}
+
+	select {
+	case ch <- l:
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+
+	select {
+	case ret := <-l.resCh:
+		return ret.value, ret.err
+	case <-ctx.Done():
+		// Stop waiting on the line
+		c.cancelCh <- l
+		return zero, ctx.Err()
+	}
 }
 
 // Create a new entry
-func (c *Cache) Create(e Entry) bool {
+func (c *Typed[K, V]) Create(e V) bool {
 	res := make(chan bool)
-	c.createCh <- create{entry: e, resCh: res}
+	c.createCh <- create[V]{entry: e, resCh: res}
 	ret := <-res
 	return ret
 }
 
+// Copy back entries as soon as they are modified instead of when they are
+// removed from the cache. Must be called before the cache is used.
+func (c *Typed[K, V]) SetWriteThrough(on bool) {
+	c.writeThrough = on
+}
+
+// Remember keys that are not found for the given time, so that lookups of
+// them fail without asking the loader again. Keys that fail with other
+// errors are not remembered. Must be called before the cache is used.
+func (c *Typed[K, V]) SetNotFoundTTL(ttl time.Duration) {
+	c.notFoundTTL = ttl
+}
+
+// Indicate that the entry with the given key has been modified and needs to
+// be copied back. Entries that are not modified are not copied back.
+func (c *Typed[K, V]) Modified(key K) {
+	c.modifiedCh <- key
+}
+
+// Remove the entry with the given key without copying it back. Lookups
+// waiting for the entry to be got are told it was not found.
+func (c *Typed[K, V]) Delete(key K) {
+	c.deleteCh <- key
+}
+
+// Discard the entry with the given key so that the next lookup gets it
+// again. A modified entry is copied back first so that the changes are not
+// lost. Lookups waiting for the entry to be got wait for it to be got again.
+func (c *Typed[K, V]) Invalidate(key K) {
+	c.Flush(key)
+	c.invalidateCh <- key
+}
+
+// Copy back the entry with the given key if it has been modified and wait
+// for the copy back to complete
+func (c *Typed[K, V]) Flush(key K) {
+	done := make(chan bool)
+	c.flushCh <- flush[K]{key: key, done: done}
+	<-done
+}
+
+// Copy back all modified entries and wait for the copy backs to complete
+func (c *Typed[K, V]) FlushAll() {
+	done := make(chan bool)
+	c.flushCh <- flush[K]{all: true, done: done}
+	<-done
+}
+
+// Get a snapshot of the cache statistics
+func (c *Typed[K, V]) Stats() Stats {
+	res := make(chan Stats)
+	c.statsCh <- res
+	return <-res
+}
+
 // Handle requests made to the given cache
-func cacheRequests(c *Cache) {
+func cacheRequests[K comparable, V KeyedEntry[K]](c *Typed[K, V]) {
 	for {
 		select {
 		case ls := <-c.lookupSync:
@@ -130,6 +320,18 @@ func cacheRequests(c *Cache) {
 			cr.resCh <- c.createEntry(cr.entry)
 		case n := <-c.notFound:
 			c.keyNotFound(n)
+		case l := <-c.cancelCh:
+			c.cancel(l)
+		case k := <-c.deleteCh:
+			c.deleteLine(k)
+		case k := <-c.invalidateCh:
+			c.invalidate(k)
+		case m := <-c.modifiedCh:
+			c.modified(m)
+		case f := <-c.flushCh:
+			c.flush(f)
+		case st := <-c.statsCh:
+			st <- c.snapshot()
 		case _ = <-c.ttlPoll:
 			c.timeout()
 		}
@@ -137,136 +339,294 @@ func cacheRequests(c *Cache) {
 }
 
 // Handle get requests
-func getRequests(c *Cache) {
+func getRequests[K comparable, V KeyedEntry[K]](c *Typed[K, V]) {
 	// This is cyclical to prevent deadlock
 	for {
-		key := <-c.getCh
-		e, ok := c.get(key)
-		if ok {
-			c.put <- e
+		l := <-c.getCh
+		e, err := c.get(l.key)
+		if err == nil {
+			c.put <- gotEntry[V]{entry: e, id: l.id}
 		} else {
-			c.notFound <- key
+			c.notFound <- failure[K]{key: l.key, id: l.id, err: err}
 		}
 	}
 }
 
 // Handle copy back requests
-func cpRequests(c *Cache) {
+func cpRequests[K comparable, V KeyedEntry[K]](c *Typed[K, V]) {
 	for {
-		e := <-c.cpCh
-		c.cp(e)
+		cb := <-c.cpCh
+		if cb.done != nil {
+			cb.done <- true
+		} else {
+			c.cp(cb.entry)
+		}
 	}
 }
 
+// Take a snapshot of the cache statistics
+func (c *Typed[K, V]) snapshot() Stats {
+	ret := c.stats
+	ret.Lines = len(c.lines)
+	ret.Backlog = len(c.cpCh)
+
+	for _, line := range c.lines {
+		ret.Waiting += len(line.waiting)
+	}
+
+	return ret
+}
+
 // Lookup an entry synchronously
-func (c *Cache) syncLookup(l lookup) {
-	line, ok := c.lines[l.key]
+func (c *Typed[K, V]) syncLookup(l lookup[K, V]) {
+	line, ok := c.findLine(l.key)
+
 	if !ok {
 		// Create an empty cache line to wait for the result
 		line = c.newLine(l.key)
 		line.waiting = append(line.waiting, l.resCh)
 
 		// Lookup the value
-		c.getCh <- l.key
+		c.startLoad(l.key, line)
 		return
 	} else if line.empty {
 		// Append to the waiting slice
 		line.waiting = append(line.waiting, l.resCh)
 		return
+	} else if line.notFound {
+		// The key is known not to exist
+		l.resCh <- result[V]{err: ErrNotFound}
 	} else {
 		// A non-empty entry exists
 		c.updateLRU(line)
-		l.resCh <- result{value: line.payload, ok: true}
+		l.resCh <- result[V]{value: line.payload}
 	}
 }
 
 // Lookup an entry asynchronously
-func (c *Cache) asyncLookup(l lookup) {
-	line, ok := c.lines[l.key]
+func (c *Typed[K, V]) asyncLookup(l lookup[K, V]) {
+	line, ok := c.findLine(l.key)
+
 	if !ok {
 		// Create an empty cache line
 		line = c.newLine(l.key)
 
 		// Signal value not present
-		l.resCh <- result{value: nil, ok: false}
+		l.resCh <- result[V]{err: ErrPending}
 
 		// Lookup the value
-		c.getCh <- l.key
+		c.startLoad(l.key, line)
 
 	} else if line.empty {
 		// Signal value not present
-		l.resCh <- result{value: nil, ok: false}
+		l.resCh <- result[V]{err: ErrPending}
+	} else if line.notFound {
+		// The key is known not to exist
+		l.resCh <- result[V]{err: ErrNotFound}
 	} else {
 		// The entry is valid
 		c.updateLRU(line)
-		l.resCh <- result{value: line.payload, ok: true}
+		l.resCh <- result[V]{value: line.payload}
+	}
+}
+
+// Find the line for a lookup and count the lookup
+func (c *Typed[K, V]) findLine(k K) (*line[V], bool) {
+	line, ok := c.lines[k]
+
+	// Forget keys that were not found once they expire
+	if ok && line.notFound && time.Now().After(line.expires) {
+		c.dropLine(k)
+		ok = false
+	}
+
+	if !ok || line.empty {
+		c.stats.Misses++
+	} else if line.notFound {
+		c.stats.KnownAbsent++
+	} else {
+		c.stats.Hits++
+	}
+
+	return line, ok
+}
+
+// Request the entry for an empty line
+func (c *Typed[K, V]) startLoad(key K, l *line[V]) {
+	c.loads++
+	l.load = c.loads
+	c.getCh <- getRequest[K]{key: key, id: l.load}
+}
+
+// Stop a lookup waiting on an empty line
+func (c *Typed[K, V]) cancel(l lookup[K, V]) {
+	line, ok := c.lines[l.key]
+	if !ok || !line.empty {
+		return
+	}
+
+	for i, ch := range line.waiting {
+		if ch == l.resCh {
+			line.waiting = append(line.waiting[:i], line.waiting[i+1:]...)
+			return
+		}
 	}
 }
 
 // Put a value into the cache
-func (c *Cache) putEntry(e Entry) {
+func (c *Typed[K, V]) putEntry(p gotEntry[V]) {
+	e := p.entry
 	line, ok := c.lines[e.Key()]
-	if !ok {
-		// Create a new cache line
-		line = c.newLine(e.Key())
-		line.payload = e
-		line.empty = false
+	if !ok || !line.empty || line.load != p.id {
+		// The line was deleted or invalidated while the entry was got
 		return
 	}
 
-	// Update the entry that is already present
+	// Fill the empty line
 	line.payload = e
 	line.empty = false
 
 	// Inform any channels that are waiting on the result
 	for _, ch := range line.waiting {
-		ch <- result{value: e, ok: true}
+		ch <- result[V]{value: e}
 	}
+	line.waiting = line.waiting[:0]
 }
 
 // Create a new entry in the cache
-func (c *Cache) createEntry(e Entry) bool {
+func (c *Typed[K, V]) createEntry(e V) bool {
 	line, ok := c.lines[e.Key()]
-	if ok {
+	if ok && !line.notFound {
 		return false
 	}
 
-	// Create a new cache line
+	// The key exists now
+	c.dropLine(e.Key())
+
+	// Create a new cache line, new entries have not been copied back
 	line = c.newLine(e.Key())
 	line.payload = e
 	line.empty = false
+	line.dirty = true
+
+	if c.writeThrough {
+		c.copyBack(line)
+	}
 	return true
 }
 
-// Indicate that an entry requested by the cache was not found
-func (c *Cache) keyNotFound(k string) {
+// Mark an entry as modified
+func (c *Typed[K, V]) modified(k K) {
 	line, ok := c.lines[k]
-	if !ok {
+	if !ok || line.empty || line.notFound {
+		return
+	}
+
+	line.dirty = true
+	if c.writeThrough {
+		c.copyBack(line)
+	}
+}
+
+// Copy back modified entries and signal when the copy backs are complete
+func (c *Typed[K, V]) flush(f flush[K]) {
+	if f.all {
+		for _, line := range c.lines {
+			c.copyBack(line)
+		}
+	} else if line, ok := c.lines[f.key]; ok {
+		c.copyBack(line)
+	}
+
+	// Copy backs are done in order so the marker completes last
+	c.cpCh <- copyBack[V]{done: f.done}
+}
+
+// Copy back a line if it has been modified
+func (c *Typed[K, V]) copyBack(l *line[V]) {
+	if l.dirty && !l.empty {
+		c.cpCh <- copyBack[V]{entry: l.payload}
+		l.dirty = false
+		c.stats.CopyBacks++
+	}
+}
+
+// Indicate that an entry requested by the cache could not be got
+func (c *Typed[K, V]) keyNotFound(f failure[K]) {
+	if errors.Is(f.err, ErrNotFound) {
+		c.stats.NotFound++
+	} else {
+		c.stats.Errors++
+	}
+
+	k := f.key
+	line, ok := c.lines[k]
+	if !ok || !line.empty || line.load != f.id {
 		// Nobody is waiting on the result
 		return
 	}
 
-	// Inform any channels that are waiting 
+	// Inform any channels that are waiting
+	for _, ch := range line.waiting {
+		ch <- result[V]{err: f.err}
+	}
+
+	// Remember keys that are not found
+	if c.notFoundTTL > 0 && errors.Is(f.err, ErrNotFound) {
+		line.empty = false
+		line.notFound = true
+		line.expires = time.Now().Add(c.notFoundTTL)
+		line.waiting = line.waiting[:0]
+		return
+	}
+
+	// Remove the cache line
+	c.dropLine(k)
+	return
+}
+
+// Remove a line without copying it back
+func (c *Typed[K, V]) deleteLine(k K) {
+	line, ok := c.lines[k]
+	if !ok {
+		return
+	}
+
+	// Inform any channels that are waiting
 	if line.empty {
 		for _, ch := range line.waiting {
-			ch <- result{value: nil, ok: false}
+			ch <- result[V]{err: ErrNotFound}
 		}
 	}
 
-	// Remove the cache line 
-	c.removeLine(k)
-	return
+	c.dropLine(k)
+}
+
+// Discard the entry of a line so that it is got again
+func (c *Typed[K, V]) invalidate(k K) {
+	line, ok := c.lines[k]
+	if !ok {
+		return
+	}
+
+	if line.empty {
+		// The entry being got may be stale, get it again for the waiters
+		c.startLoad(k, line)
+	} else {
+		// Copy back changes made since the flush
+		c.removeLine(k)
+	}
 }
 
 // Remove entries from the cache that have exceeded the ttl
-func (c *Cache) timeout() {
+func (c *Typed[K, V]) timeout() {
 	timeout := time.Now().Add(-c.ttl)
 
 	// Loop through the LRU list
 	for lru := c.lruList.Back(); lru != nil; lru = c.lruList.Back() {
-		key, ok := lru.Value.(string)
+		key, ok := lru.Value.(K)
 		if !ok {
-			log.Fatal("Got a non-string key out of lruList")
+			log.Fatal("Got a key of the wrong type out of lruList")
 		}
 
 		// Check when the entry was last used
@@ -274,6 +634,7 @@ func (c *Cache) timeout() {
 		if ok {
 			if line.lastUse.Before(timeout) {
 				c.removeLine(key)
+				c.stats.Expirations++
 			} else {
 				break
 			}
@@ -285,10 +646,10 @@ func (c *Cache) timeout() {
 }
 
 // Create a new cache line with the given key
-func (c *Cache) newLine(k string) *line {
+func (c *Typed[K, V]) newLine(k K) *line[V] {
 
-	line := &line{empty: true, lastUse: time.Now()}
-	line.waiting = make([]chan result, 0, 4)
+	line := &line[V]{empty: true, lastUse: time.Now()}
+	line.waiting = make([]chan result[V], 0, 4)
 
 	// Is the cache full?
 	if len(c.lines) >= c.size {
@@ -302,33 +663,51 @@ func (c *Cache) newLine(k string) *line {
 }
 
 // Update the LRU entry for the given cache line
-func (c *Cache) updateLRU(l *line) {
+func (c *Typed[K, V]) updateLRU(l *line[V]) {
 	l.lastUse = time.Now()
 	c.lruList.MoveToFront(l.lruEntry)
 }
 
 // Remove a line from the cache
-func (c *Cache) removeLine(key string) {
+func (c *Typed[K, V]) removeLine(key K) {
 	line, ok := c.lines[key]
-	if ok {
-		lru := line.lruEntry
-		c.lruList.Remove(lru)
-		delete(c.lines, key)
+	if !ok {
+		return
 	}
 
-	// Copy back the entry in case it has changed
-	if !line.empty {
-		c.cpCh <- line.payload
-	}
+	c.dropLine(key)
+
+	// Copy back the entry if it has changed
+	c.copyBack(line)
 }
 
-// Remove the least recently used line from the cache
-func (c *Cache) removeLRU() {
-	oldest := c.lruList.Back()
-	key, ok := oldest.Value.(string)
+// Remove a line from the cache without copying it back
+func (c *Typed[K, V]) dropLine(key K) {
+	line, ok := c.lines[key]
 	if !ok {
-		log.Fatal("Got a non-string key out of lruList")
+		return
 	}
 
-	c.removeLine(key)
+	c.lruList.Remove(line.lruEntry)
+	delete(c.lines, key)
+}
+
+// Remove the least recently used line from the cache
+func (c *Typed[K, V]) removeLRU() {
+	for lru := c.lruList.Back(); lru != nil; lru = lru.Prev() {
+		key, ok := lru.Value.(K)
+		if !ok {
+			log.Fatal("Got a key of the wrong type out of lruList")
+		}
+
+		// Lines that are being filled have lookups waiting on them, the
+		// cache grows past its size rather than abandon them
+		if line, ok := c.lines[key]; ok && line.empty {
+			continue
+		}
+
+		c.removeLine(key)
+		c.stats.Evictions++
+		return
+	}
 }
@@ -1,6 +1,10 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -86,6 +90,9 @@ func TestTTL(t *testing.T) {
 		t.Error("Failure with synchronous get")
 	}
 
+	// Only modified entries are copied back
+	c.Modified("testo")
+
 	// Sleep ttl
 	time.Sleep(2 * time.Second)
 
@@ -152,3 +159,532 @@ func TestCreate(t *testing.T) {
 		}
 	}
 }
+
+// Test that only modified entries are copied back
+func TestModified(t *testing.T) {
+
+	cpCh := make(chan Entry, 4)
+
+	c := New(1, 20*time.Second,
+		func(key string) (Entry, bool) { return &testEntry{key: key, value: "pass"}, true },
+		func(e Entry) { cpCh <- e })
+
+	// Evict an unmodified entry
+	c.Get("clean")
+	c.Get("modified")
+
+	// Evict a modified entry
+	c.Modified("modified")
+	c.Get("other")
+
+	cpEntry := <-cpCh
+	if cpEntry.Key() != "modified" {
+		t.Error("Copied back an unmodified entry:", cpEntry.Key())
+	}
+}
+
+// Test flushing entries
+func TestFlush(t *testing.T) {
+
+	cpCh := make(chan Entry, 4)
+
+	c := New(4, 20*time.Second,
+		func(key string) (Entry, bool) { return &testEntry{key: key, value: "pass"}, true },
+		func(e Entry) { cpCh <- e })
+
+	c.Get("one")
+	c.Get("two")
+	c.Get("three")
+
+	// Flushing an unmodified entry does nothing
+	c.Flush("one")
+	if len(cpCh) != 0 {
+		t.Error("Flushed an unmodified entry")
+	}
+
+	// Flush a modified entry
+	c.Modified("one")
+	c.Flush("one")
+	if len(cpCh) != 1 || (<-cpCh).Key() != "one" {
+		t.Error("Did not flush a modified entry")
+	}
+
+	// A flushed entry is no longer modified
+	c.Flush("one")
+	if len(cpCh) != 0 {
+		t.Error("Flushed an entry twice")
+	}
+
+	// Flush all the modified entries
+	c.Modified("two")
+	c.Modified("three")
+	c.FlushAll()
+	if len(cpCh) != 2 {
+		t.Error("FlushAll copied back", len(cpCh), "entries instead of 2")
+	}
+}
+
+// Test write through
+func TestWriteThrough(t *testing.T) {
+
+	cpCh := make(chan Entry, 4)
+
+	c := New(4, 20*time.Second,
+		func(key string) (Entry, bool) { return &testEntry{key: key, value: "pass"}, true },
+		func(e Entry) { cpCh <- e })
+	c.SetWriteThrough(true)
+
+	// New entries are written through
+	c.Create(&testEntry{key: "new", value: "pass"})
+	if (<-cpCh).Key() != "new" {
+		t.Error("Created entry was not written through")
+	}
+
+	// Modified entries are written through
+	c.Get("testo")
+	c.Modified("testo")
+	if (<-cpCh).Key() != "testo" {
+		t.Error("Modified entry was not written through")
+	}
+
+	// There is nothing left to flush
+	c.FlushAll()
+	if len(cpCh) != 0 {
+		t.Error("Written through entries were flushed")
+	}
+}
+
+// Test the cache statistics
+func TestStats(t *testing.T) {
+
+	c := New(2, 20*time.Second,
+		func(key string) (Entry, bool) {
+			if key == "missing" {
+				return nil, false
+			}
+			return &testEntry{key: key, value: "pass"}, true
+		},
+		func(e Entry) {})
+
+	// A miss followed by a hit
+	c.Get("one")
+	c.Get("one")
+
+	// A miss that is not found
+	c.Get("missing")
+
+	// A miss that evicts the least recently used entry
+	c.Get("two")
+	c.Get("three")
+
+	stats := c.Stats()
+
+	if stats.Hits != 1 {
+		t.Error("Wrong number of hits:", stats.Hits)
+	}
+
+	if stats.Misses != 4 {
+		t.Error("Wrong number of misses:", stats.Misses)
+	}
+
+	if stats.NotFound != 1 {
+		t.Error("Wrong number of not found:", stats.NotFound)
+	}
+
+	if stats.Evictions != 1 {
+		t.Error("Wrong number of evictions:", stats.Evictions)
+	}
+
+	if stats.Lines != 2 || stats.Waiting != 0 {
+		t.Error("Wrong number of lines or waiters:", stats.Lines, stats.Waiting)
+	}
+}
+
+// An entry type with an integer key
+type intEntry struct {
+	key   int
+	value string
+}
+
+func (e *intEntry) Key() int {
+	return e.key
+}
+
+// Test a typed cache with integer keys
+func TestTyped(t *testing.T) {
+
+	cpCh := make(chan *intEntry, 1)
+
+	c := NewTyped(1, 20*time.Second,
+		func(key int) (*intEntry, bool) {
+			if key < 0 {
+				return nil, false
+			}
+			return &intEntry{key: key, value: "pass"}, true
+		},
+		func(e *intEntry) { cpCh <- e })
+
+	// Entries are returned without a type assertion
+	entry, ok := c.Get(1)
+	if !ok || entry.key != 1 || entry.value != "pass" {
+		t.Error("Incorrect value from typed get", entry)
+	}
+
+	if entry, ok := c.Get(-1); ok || entry != nil {
+		t.Error("Typed get found a missing entry", entry)
+	}
+
+	// A modified entry is copied back when it is evicted
+	c.Get(2)
+	c.Modified(2)
+	c.Get(3)
+
+	select {
+	case e := <-cpCh:
+		if e.key != 2 {
+			t.Error("Copied back the wrong entry", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Evicted entry was not copied back")
+	}
+}
+
+// Test lookups that are abandoned when the context is done
+func TestGetContext(t *testing.T) {
+
+	release := make(chan bool)
+	failed := errors.New("failed")
+
+	c := NewTypedLoader(2, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			switch key {
+			case "slow":
+				<-release
+			case "missing":
+				return nil, ErrNotFound
+			case "broken":
+				return nil, failed
+			}
+			return &testEntry{key: key, value: "pass"}, nil
+		},
+		func(e *testEntry) {})
+
+	// Give up waiting on a loader that hangs
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.GetContext(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Error("Lookup did not time out:", err)
+	}
+
+	if stats := c.Stats(); stats.Waiting != 0 {
+		t.Error("Abandoned lookup is still waiting:", stats.Waiting)
+	}
+
+	// The entry is still filled once the loader completes
+	release <- true
+	entry, err := c.GetContext(context.Background(), "slow")
+	if err != nil || entry.value != "pass" {
+		t.Error("Incorrect value after an abandoned lookup", entry, err)
+	}
+
+	// Asynchronous lookups do not wait for the loader
+	if _, err := c.GetAsyncContext(context.Background(), "other"); err != ErrPending {
+		t.Error("Asynchronous lookup of a missing entry returned:", err)
+	}
+
+	// Loader errors are returned
+	if _, err := c.GetContext(context.Background(), "missing"); err != ErrNotFound {
+		t.Error("Lookup of a missing key returned:", err)
+	}
+
+	if _, err := c.GetContext(context.Background(), "broken"); err != failed {
+		t.Error("Lookup did not return the loader error:", err)
+	}
+
+	stats := c.Stats()
+	if stats.NotFound != 1 || stats.Errors != 1 {
+		t.Error("Wrong number of failures:", stats.NotFound, stats.Errors)
+	}
+}
+
+// Test a sharded cache
+func TestSharded(t *testing.T) {
+
+	cpCh := make(chan *testEntry, 16)
+
+	c := NewSharded(4, 64, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			return &testEntry{key: key, value: "pass"}, nil
+		},
+		func(e *testEntry) { cpCh <- e })
+
+	for i := 0; i < 8; i++ {
+		key := strconv.Itoa(i)
+		entry, ok := c.Get(key)
+		if !ok || entry.key != key {
+			t.Error("Incorrect value from sharded get", entry)
+		}
+		c.Modified(key)
+	}
+
+	c.Get("0")
+
+	stats := c.Stats()
+	if stats.Lines != 8 || stats.Hits != 1 || stats.Misses != 8 {
+		t.Error("Wrong sharded statistics:", stats)
+	}
+
+	// Modified entries in every shard are copied back
+	c.FlushAll()
+	if len(cpCh) != 8 {
+		t.Error("Wrong number of entries copied back:", len(cpCh))
+	}
+}
+
+// Test deleting and invalidating entries
+func TestDelete(t *testing.T) {
+
+	cpCh := make(chan *testEntry, 4)
+	release := make(chan bool)
+	loads := 0
+
+	c := NewTypedLoader(4, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			if key == "slow" {
+				<-release
+			}
+			loads++
+			return &testEntry{key: key, value: strconv.Itoa(loads)}, nil
+		},
+		func(e *testEntry) { cpCh <- e })
+
+	// Deleted entries are not copied back
+	c.Get("testo")
+	c.Modified("testo")
+	c.Delete("testo")
+	c.FlushAll()
+
+	if len(cpCh) != 0 {
+		t.Error("Deleted entry was copied back")
+	}
+
+	// Invalidated entries are got again
+	first, _ := c.Get("testo")
+	c.Invalidate("testo")
+	second, _ := c.Get("testo")
+
+	if first == second || second.value != "3" {
+		t.Error("Invalidated entry was not got again", first, second)
+	}
+
+	// Lookups waiting on a deleted entry are told it was not found
+	res := make(chan error)
+	wait := func() {
+		_, err := c.GetContext(context.Background(), "slow")
+		res <- err
+	}
+
+	go wait()
+	for c.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Delete("slow")
+	if err := <-res; err != ErrNotFound {
+		t.Error("Lookup waiting on a deleted entry returned:", err)
+	}
+
+	// The entry that was being got is discarded
+	release <- true
+	if _, ok := c.GetAsync("slow"); ok {
+		t.Error("Deleted entry was put in the cache")
+	}
+
+	// Lookups waiting on an invalidated entry wait for it to be got again
+	go wait()
+	for c.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Invalidate("slow")
+	release <- true
+	release <- true
+	if err := <-res; err != nil {
+		t.Error("Lookup waiting on an invalidated entry returned:", err)
+	}
+
+	if stats := c.Stats(); stats.Waiting != 0 {
+		t.Error("Lookups still waiting:", stats.Waiting)
+	}
+}
+
+// Test that invalidating a modified entry keeps the modifications
+func TestInvalidateModified(t *testing.T) {
+
+	stored := map[string]string{"testo": "original"}
+	loads := 0
+
+	c := NewTypedLoader(4, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			loads++
+			return &testEntry{key: key, value: stored[key]}, nil
+		},
+		func(e *testEntry) { stored[e.key] = e.value })
+
+	e, _ := c.Get("testo")
+	e.value = "modified"
+	c.Modified("testo")
+	c.Invalidate("testo")
+
+	e, _ = c.Get("testo")
+	if loads != 2 || e.value != "modified" {
+		t.Error("Invalidated entry lost its modifications:", loads, e.value)
+	}
+}
+
+// Test remembering keys that are not found
+func TestNotFoundTTL(t *testing.T) {
+
+	failed := errors.New("failed")
+	loads := 0
+
+	c := NewTypedLoader(4, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			loads++
+			if key == "broken" {
+				return nil, failed
+			}
+			return nil, ErrNotFound
+		},
+		func(e *testEntry) {})
+	c.SetNotFoundTTL(100 * time.Millisecond)
+
+	// Only the first lookup asks the loader
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetContext(context.Background(), "missing"); err != ErrNotFound {
+			t.Error("Lookup of a missing key returned:", err)
+		}
+	}
+
+	if _, ok := c.GetAsync("missing"); ok || loads != 1 {
+		t.Error("Missing key was got again:", loads)
+	}
+
+	if stats := c.Stats(); stats.KnownAbsent != 3 {
+		t.Error("Wrong number of lookups of keys known to be absent:", stats.KnownAbsent)
+	}
+
+	// Other errors are not remembered
+	c.Get("broken")
+	c.Get("broken")
+	if loads != 3 {
+		t.Error("Key that failed was not got again:", loads)
+	}
+
+	// Keys are got again once they expire
+	time.Sleep(150 * time.Millisecond)
+	c.Get("missing")
+	if loads != 4 {
+		t.Error("Missing key was not got again after it expired:", loads)
+	}
+
+	// Keys that were not found can be created
+	if !c.Create(&testEntry{key: "missing", value: "pass"}) {
+		t.Error("Could not create a key that was not found")
+	}
+
+	if entry, ok := c.Get("missing"); !ok || entry.value != "pass" {
+		t.Error("Incorrect value for a created key", entry)
+	}
+}
+
+// Test that lines being filled are not evicted from a full cache
+func TestEvictFilling(t *testing.T) {
+
+	release := make(chan bool)
+
+	c := NewTypedLoader(1, 20*time.Second,
+		func(key string) (*testEntry, error) {
+			if key == "slow" {
+				<-release
+			}
+			return &testEntry{key: key, value: "pass"}, nil
+		},
+		func(e *testEntry) {})
+
+	// Wait on a line that is being filled
+	res := make(chan bool)
+	go func() {
+		entry, ok := c.Get("slow")
+		res <- ok && entry.value == "pass"
+	}()
+
+	for c.Stats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Lookups of another key in the full cache are made while loading
+	c.GetAsync("fast")
+	release <- true
+
+	select {
+	case ok := <-res:
+		if !ok {
+			t.Error("Incorrect value for a line that was being filled")
+		}
+	case <-time.After(time.Second):
+		t.Error("Lookup was abandoned when the cache was full")
+	}
+}
+
+// The number of keys used by the benchmarks, all of which fit in the cache
+const benchmarkKeys = 1000
+
+// Get entries from a cache in parallel
+func benchmarkGet(b *testing.B, get func(string) (*testEntry, bool)) {
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			get(keys[rand.Intn(len(keys))])
+		}
+	})
+}
+
+// Load entries for the benchmarks
+func benchmarkLoad(key string) (*testEntry, error) {
+	return &testEntry{key: key, value: "pass"}, nil
+}
+
+func BenchmarkTyped(b *testing.B) {
+	c := NewTypedLoader(2*benchmarkKeys, time.Minute, benchmarkLoad, func(e *testEntry) {})
+	benchmarkGet(b, c.Get)
+}
+
+func BenchmarkSharded(b *testing.B) {
+	c := NewSharded(16, 2*benchmarkKeys, time.Minute, benchmarkLoad, func(e *testEntry) {})
+	benchmarkGet(b, c.Get)
+}
+
+// Load entries slowly, as a db would, for a cache too small to hold them
+func benchmarkSlowLoad(key string) (*testEntry, error) {
+	time.Sleep(100 * time.Microsecond)
+	return &testEntry{key: key, value: "pass"}, nil
+}
+
+func BenchmarkTypedSlowLoad(b *testing.B) {
+	c := NewTypedLoader(benchmarkKeys/10, time.Minute, benchmarkSlowLoad, func(e *testEntry) {})
+	b.SetParallelism(16)
+	benchmarkGet(b, c.Get)
+}
+
+func BenchmarkShardedSlowLoad(b *testing.B) {
+	c := NewSharded(16, benchmarkKeys/10, time.Minute, benchmarkSlowLoad, func(e *testEntry) {})
+	b.SetParallelism(16)
+	benchmarkGet(b, c.Get)
+}
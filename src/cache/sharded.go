@@ -0,0 +1,137 @@
+package cache
+
+// A cache split into independent shards so that lookups of different keys
+// don't wait on each other
+
+import (
+	"context"
+	"hash/maphash"
+	"time"
+)
+
+// A concurrent copy back cache made of typed caches that each hold a share
+// of the keys. Each shard has its own LRU list, ttl sweep, loader and copy
+// back go routines, so loaders and copy backs can run concurrently.
+type Sharded[K comparable, V KeyedEntry[K]] struct {
+	shards []*Typed[K, V]
+	seed   maphash.Seed
+}
+
+// Create a new sharded cache holding up to size entries in total
+func NewSharded[K comparable, V KeyedEntry[K]](shards, size int, ttl time.Duration,
+	load func(K) (V, error), cp func(V)) *Sharded[K, V] {
+	if shards < 1 {
+		shards = 1
+	}
+
+	// Share the size between the shards
+	shardSize := (size + shards - 1) / shards
+
+	ret := &Sharded[K, V]{
+		shards: make([]*Typed[K, V], shards),
+		seed:   maphash.MakeSeed()}
+
+	for i := range ret.shards {
+		ret.shards[i] = NewTypedLoader(shardSize, ttl, load, cp)
+	}
+
+	return ret
+}
+
+// Get the shard that holds the given key
+func (c *Sharded[K, V]) shard(key K) *Typed[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Get an entry from the cache only if immediately available and fill the
+// cache asynchronously if the key is not present
+func (c *Sharded[K, V]) GetAsync(key K) (value V, present bool) {
+	return c.shard(key).GetAsync(key)
+}
+
+// Get an entry from the cache and synchronously get the value if not present
+func (c *Sharded[K, V]) Get(key K) (value V, ok bool) {
+	return c.shard(key).Get(key)
+}
+
+// Get an entry from the cache only if immediately available, returning
+// ErrPending and filling the cache asynchronously if the key is not present
+func (c *Sharded[K, V]) GetAsyncContext(ctx context.Context, key K) (V, error) {
+	return c.shard(key).GetAsyncContext(ctx, key)
+}
+
+// Get an entry from the cache and synchronously get the value if not present
+func (c *Sharded[K, V]) GetContext(ctx context.Context, key K) (V, error) {
+	return c.shard(key).GetContext(ctx, key)
+}
+
+// Create a new entry
+func (c *Sharded[K, V]) Create(e V) bool {
+	return c.shard(e.Key()).Create(e)
+}
+
+// Copy back entries as soon as they are modified. Must be called before the
+// cache is used.
+func (c *Sharded[K, V]) SetWriteThrough(on bool) {
+	for _, s := range c.shards {
+		s.SetWriteThrough(on)
+	}
+}
+
+// Remember keys that are not found for the given time. Must be called
+// before the cache is used.
+func (c *Sharded[K, V]) SetNotFoundTTL(ttl time.Duration) {
+	for _, s := range c.shards {
+		s.SetNotFoundTTL(ttl)
+	}
+}
+
+// Indicate that the entry with the given key has been modified
+func (c *Sharded[K, V]) Modified(key K) {
+	c.shard(key).Modified(key)
+}
+
+// Remove the entry with the given key without copying it back
+func (c *Sharded[K, V]) Delete(key K) {
+	c.shard(key).Delete(key)
+}
+
+// Discard the entry with the given key so that the next lookup gets it
+// again, copying it back first if it has been modified
+func (c *Sharded[K, V]) Invalidate(key K) {
+	c.shard(key).Invalidate(key)
+}
+
+// Copy back the entry with the given key if it has been modified and wait
+// for the copy back to complete
+func (c *Sharded[K, V]) Flush(key K) {
+	c.shard(key).Flush(key)
+}
+
+// Copy back all modified entries and wait for the copy backs to complete
+func (c *Sharded[K, V]) FlushAll() {
+	for _, s := range c.shards {
+		s.FlushAll()
+	}
+}
+
+// Get the statistics of all the shards added together
+func (c *Sharded[K, V]) Stats() Stats {
+	var ret Stats
+	for _, s := range c.shards {
+		st := s.Stats()
+		ret.Lines += st.Lines
+		ret.Waiting += st.Waiting
+		ret.Backlog += st.Backlog
+		ret.Hits += st.Hits
+		ret.Misses += st.Misses
+		ret.NotFound += st.NotFound
+		ret.KnownAbsent += st.KnownAbsent
+		ret.Errors += st.Errors
+		ret.Evictions += st.Evictions
+		ret.Expirations += st.Expirations
+		ret.CopyBacks += st.CopyBacks
+	}
+
+	return ret
+}
@@ -0,0 +1,36 @@
+package cache
+
+// An untyped cache with string keys, callers convert the entries they get
+
+import (
+	"time"
+)
+
+// A concurrent copy back cache of any entries with string keys
+type Cache struct {
+	*Typed[string, Entry]
+}
+
+// Create a new cache with functions to make get requests and to copy back data
+func New(size int, ttl time.Duration, get func(string) (Entry, bool), cp func(Entry)) *Cache {
+	return &Cache{NewTyped[string, Entry](size, ttl, get, cp)}
+}
+
+// Get an entry from the cache only if immediately available and fill the
+// cache asynchronously if the key is not present
+func (c *Cache) GetAsync(key string) (value interface{}, present bool) {
+	e, ok := c.Typed.GetAsync(key)
+	if !ok {
+		return nil, false
+	}
+	return e, true
+}
+
+// Get an entry from the cache and synchronously get the value if not present
+func (c *Cache) Get(key string) (value interface{}, ok bool) {
+	e, ok := c.Typed.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return e, true
+}